@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	diffContext = 3
+	colorReset  = "\033[0m"
+	colorRed    = "\033[0;31m"
+	colorGreen  = "\033[0;32m"
+	colorCyan   = "\033[0;36m"
+)
+
+//diffOp a line of an edit script : ' ' kept, '-' removed, '+' added
+type diffOp struct {
+	kind byte
+	line string
+}
+
+//diffTemplate render the template and compare it with the target file, printing the diff to out if not nil, returns true on drift
+func diffTemplate(t renderer, config map[string]interface{}, out io.Writer) (bool, error) {
+	content, err := renderTemplate(t, config)
+	if err != nil {
+		return false, err
+	}
+	current, err := ioutil.ReadFile(*targetFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if bytes.Equal(current, content) {
+		return false, nil
+	}
+	if out != nil {
+		w := bufio.NewWriter(out)
+		defer w.Flush()
+		writeUnifiedDiff(w, *targetFile, *targetFile+" (rendered)", current, content, *diffColor)
+	}
+	return true, nil
+}
+
+//splitLines split content in lines keeping the line endings
+func splitLines(content []byte) []string {
+	var lines []string
+	for s := string(content); s != ""; {
+		i := strings.IndexByte(s, '\n') + 1
+		if i == 0 {
+			i = len(s)
+		}
+		lines = append(lines, s[:i])
+		s = s[i:]
+	}
+	return lines
+}
+
+//diffLines compute the edit script between a and b with a longest common subsequence
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+	// common prefix and suffix are trimmed so the table only covers the changed region
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		ops = append(ops, diffOp{' ', a[prefix]})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			ops = append(ops, diffOp{' ', ma[i]})
+			i++
+			j++
+		case i < len(ma) && (j == len(mb) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', ma[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', mb[j]})
+			j++
+		}
+	}
+
+	for k := len(a) - suffix; k < len(a); k++ {
+		ops = append(ops, diffOp{' ', a[k]})
+	}
+	return ops
+}
+
+//writeUnifiedDiff write the unified diff between a and b to w
+func writeUnifiedDiff(w io.Writer, fromName, toName string, a, b []byte, color bool) {
+	ops := diffLines(splitLines(a), splitLines(b))
+	paint := func(c, s string) string {
+		if !color {
+			return s
+		}
+		return c + s + colorReset
+	}
+
+	fmt.Fprintln(w, paint(colorRed, "--- "+fromName))
+	fmt.Fprintln(w, paint(colorGreen, "+++ "+toName))
+
+	for start := 0; start < len(ops); {
+		// look for the next change
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		// extend the hunk while changes are close enough to share their context
+		last := first
+		for k := first; k < len(ops); k++ {
+			if ops[k].kind != ' ' {
+				last = k
+			} else if k-last > 2*diffContext {
+				break
+			}
+		}
+		from := first - diffContext
+		if from < start {
+			from = start
+		}
+		to := last + diffContext + 1
+		if to > len(ops) {
+			to = len(ops)
+		}
+
+		aStart, bStart := 1, 1
+		for _, op := range ops[:from] {
+			if op.kind != '+' {
+				aStart++
+			}
+			if op.kind != '-' {
+				bStart++
+			}
+		}
+		aLen, bLen := 0, 0
+		for _, op := range ops[from:to] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		if aLen == 0 {
+			aStart--
+		}
+		if bLen == 0 {
+			bStart--
+		}
+		fmt.Fprintln(w, paint(colorCyan, fmt.Sprintf("@@ -%d,%d +%d,%d @@", aStart, aLen, bStart, bLen)))
+
+		for _, op := range ops[from:to] {
+			line := string(op.kind) + strings.TrimSuffix(op.line, "\n")
+			switch op.kind {
+			case '-':
+				line = paint(colorRed, line)
+			case '+':
+				line = paint(colorGreen, line)
+			}
+			fmt.Fprintln(w, line)
+			if !strings.HasSuffix(op.line, "\n") {
+				fmt.Fprintln(w, `\ No newline at end of file`)
+			}
+		}
+		start = to
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"text/template"
+)
+
+func TestDiffLines(t *testing.T) {
+	ops := diffLines([]string{"a\n", "b\n", "c\n"}, []string{"a\n", "x\n", "c\n", "d\n"})
+	var got string
+	for _, op := range ops {
+		got += string(op.kind) + op.line
+	}
+	wanted := " a\n-b\n+x\n c\n+d\n"
+	if got != wanted {
+		t.Errorf("Edit script is wrong, want : %q, got : %q", wanted, got)
+	}
+}
+
+func TestWriteUnifiedDiff(t *testing.T) {
+	var buf bytes.Buffer
+	a := []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n")
+	b := []byte("1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve")
+	writeUnifiedDiff(&buf, "old", "new", a, b, false)
+
+	wanted := `--- old
++++ new
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+ 6
+@@ -9,4 +9,4 @@
+ 9
+ 10
+ 11
+-12
++twelve
+\ No newline at end of file
+`
+	if buf.String() != wanted {
+		t.Errorf("Unified diff is wrong, want :\n%s\ngot :\n%s", wanted, buf.String())
+	}
+}
+
+func TestWriteUnifiedDiffNewFile(t *testing.T) {
+	var buf bytes.Buffer
+	writeUnifiedDiff(&buf, "old", "new", nil, []byte("a\n"), false)
+	wanted := "--- old\n+++ new\n@@ -0,0 +1,1 @@\n+a\n"
+	if buf.String() != wanted {
+		t.Errorf("Unified diff is wrong, want : %q, got : %q", wanted, buf.String())
+	}
+}
+
+func TestDiffTemplate(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	*targetFile = filepath.Join(dir, "app.conf")
+	defer func() { *targetFile = "" }()
+	tmpl := template.Must(template.New("app").Parse("server_name {{ .Fqdn }};\nroot /srv;\n"))
+
+	tests := []struct {
+		name    string
+		current string
+		drift   bool
+		diff    string
+	}{
+		{"identical", "server_name example.org;\nroot /srv;\n", false, ""},
+		{"changed", "server_name old.org;\nroot /srv;\n", true,
+			"--- " + *targetFile + "\n+++ " + *targetFile + " (rendered)\n@@ -1,2 +1,2 @@\n-server_name old.org;\n+server_name example.org;\n root /srv;\n"},
+		{"missing trailing newline", "server_name example.org;\nroot /srv;", true,
+			"--- " + *targetFile + "\n+++ " + *targetFile + " (rendered)\n@@ -1,2 +1,2 @@\n server_name example.org;\n-root /srv;\n\\ No newline at end of file\n+root /srv;\n"},
+	}
+	for _, test := range tests {
+		ioutil.WriteFile(*targetFile, []byte(test.current), 0644)
+		var buf bytes.Buffer
+		drift, err := diffTemplate(tmpl, map[string]interface{}{"Fqdn": "example.org"}, &buf)
+		if err != nil {
+			t.Errorf("%s: diff failed : %s", test.name, err)
+		}
+		if drift != test.drift {
+			t.Errorf("%s: drift should be %v", test.name, test.drift)
+		}
+		if buf.String() != test.diff {
+			t.Errorf("%s: diff is wrong, want : %q, got : %q", test.name, test.diff, buf.String())
+		}
+	}
+}
+
+//TestCheckExitStatus run dkconf -check in a child process, exiting with 4 on drift
+func TestCheckExitStatus(t *testing.T) {
+	if os.Getenv("DKCONF_CHECK_TARGET") != "" {
+		os.Args = []string{"dkconf", "-check", "-p", "APPCONF", "-s", os.Getenv("DKCONF_CHECK_SOURCE"), "-t", os.Getenv("DKCONF_CHECK_TARGET")}
+		main()
+		os.Exit(0)
+	}
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	source, target := filepath.Join(dir, "app.tmpl"), filepath.Join(dir, "app.conf")
+	ioutil.WriteFile(source, []byte("root {{ .CheckRoot }};\n"), 0644)
+
+	for current, wanted := range map[string]int{"root /srv;\n": 0, "root /var/www;\n": 4} {
+		ioutil.WriteFile(target, []byte(current), 0644)
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCheckExitStatus$")
+		cmd.Env = append(os.Environ(), "DKCONF_CHECK_SOURCE="+source, "DKCONF_CHECK_TARGET="+target, "APPCONF_CHECK_ROOT=/srv")
+		err := cmd.Run()
+		code := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatalf("Cannot run dkconf -check : %s", err)
+		}
+		if code != wanted {
+			t.Errorf("dkconf -check with target %q should exit with %d, got %d", current, wanted, code)
+		}
+		if content, _ := ioutil.ReadFile(target); string(content) != current {
+			t.Errorf("dkconf -check should not write the target, got %q", content)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -93,9 +94,9 @@ func TestCheckFileExists(t *testing.T) {
 	}
 }
 
-type ParseFunc func(t *template.Template, config map[string]interface{}) error
+type ParseFunc func(t renderer, config map[string]interface{}) error
 
-func CaptureStdOut(function ParseFunc, t2 *template.Template, config2 map[string]interface{}) string {
+func CaptureStdOut(function ParseFunc, t2 renderer, config2 map[string]interface{}) string {
 	rescueStdout := os.Stdout
 	r, w, _ := os.Pipe()
 	os.Stdout = w
@@ -326,4 +327,247 @@ func assertParsed(t *testing.T, tpl string, parsed string) {
 	if stdout != parsed {
 		t.Errorf("Assertion failed for [%s] is parsed into [%s], found: [%s]", tpl, parsed, stdout)
 	}
-}
\ No newline at end of file
+}
+
+func TestListTemplFieldsFollowsIncludesAndIfBranches(t *testing.T) {
+	tmpl, _ := prepareTemplate(template.New("test")).Parse(`{{ .Fqdn }}{{ if .CorsEnabled }}{{ template "cors.tmpl" . }}{{ else }}{{ .NoCors }}{{ end }}`)
+	tmpl.New("cors.tmpl").Parse(`{{ .CorsOrigin }}{{ template "test" . }}`)
+
+	var fields []string
+	for _, field := range ListTemplFields(tmpl) {
+		fields = append(fields, extractFieldName(field))
+	}
+	wantedFields := []string{"Fqdn", "CorsEnabled", "CorsOrigin", "NoCors"}
+	if !reflect.DeepEqual(fields, wantedFields) {
+		t.Errorf("Fields are not equal want : %v, got : %v", wantedFields, fields)
+	}
+}
+
+func TestListTemplFieldsOfRootVariableAndChains(t *testing.T) {
+	tmpl, _ := prepareTemplate(template.New("test")).Parse(`{{ $.Fqdn }}{{ (.Server).Name }}{{ range $i, $alias := .Aliases }}{{ $alias.Name }}{{ end }}`)
+
+	var fields []string
+	for _, field := range ListTemplFields(tmpl) {
+		fields = append(fields, extractFieldName(field))
+	}
+	wantedFields := []string{"Fqdn", "Server", "Aliases"}
+	if !reflect.DeepEqual(fields, wantedFields) {
+		t.Errorf("Fields are not equal want : %v, got : %v", wantedFields, fields)
+	}
+}
+
+func TestListTemplFieldsInRangeAndWithBodies(t *testing.T) {
+	tmpl, _ := prepareTemplate(template.New("test")).Parse(`{{ range .Items }}{{ $.Name }}{{ .Port }}{{ end }}` +
+		`{{ with .Tls }}{{ .Cert }}{{ template "key.tmpl" $ }}{{ else }}{{ .NoTls }}{{ end }}`)
+	tmpl.New("key.tmpl").Parse(`{{ .Key }}`)
+
+	var fields []string
+	for _, field := range ListTemplFields(tmpl) {
+		fields = append(fields, extractFieldName(field))
+	}
+	wantedFields := []string{"Items", "Name", "Tls", "Key", "NoTls"}
+	if !reflect.DeepEqual(fields, wantedFields) {
+		t.Errorf("Fields are not equal want : %v, got : %v", wantedFields, fields)
+	}
+}
+
+func TestListTemplFieldsOfIncludeInRange(t *testing.T) {
+	tmpl, _ := prepareTemplate(template.New("test")).Parse(`{{ range .X }}{{ include "p.tmpl" $ }}{{ include "item.tmpl" . }}{{ end }}`)
+	tmpl.New("p.tmpl").Parse(`{{ .Fqdn }}`)
+	tmpl.New("item.tmpl").Parse(`{{ .Port }}`)
+
+	var fields []string
+	for _, field := range ListTemplFields(tmpl) {
+		fields = append(fields, extractFieldName(field))
+	}
+	wantedFields := []string{"X", "Fqdn"}
+	if !reflect.DeepEqual(fields, wantedFields) {
+		t.Errorf("Fields are not equal want : %v, got : %v", wantedFields, fields)
+	}
+}
+
+func TestRetrieveEnvOfRootVariable(t *testing.T) {
+	os.Setenv("APPCONF_FQDN", "x.com")
+	defer os.Unsetenv("APPCONF_FQDN")
+	tmpl, _ := prepareTemplate(template.New("test")).Parse(`A={{ $.Fqdn }}`)
+
+	config, missing := retrieveEnv(tmpl)
+	content, _ := renderTemplate(tmpl, config)
+	if string(content) != "A=x.com" || len(missing) != 0 {
+		t.Errorf("$.Fqdn should be looked up, got [%s] missing %v", content, missing)
+	}
+}
+
+func TestInitializeTemplateWithIncludes(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	shared, local := filepath.Join(dir, "shared"), filepath.Join(dir, "local")
+	os.Mkdir(shared, 0755)
+	os.Mkdir(local, 0755)
+	ioutil.WriteFile(filepath.Join(shared, "cors.tmpl"), []byte("shared cors {{ .CorsOrigin }}"), 0644)
+	ioutil.WriteFile(filepath.Join(local, "cors.tmpl"), []byte("local cors {{ .CorsOrigin }}"), 0644)
+	ioutil.WriteFile(filepath.Join(shared, "tls.tmpl"), []byte("tls"), 0644)
+	*sourceTplFile = filepath.Join(dir, "vhost.tmpl")
+	ioutil.WriteFile(*sourceTplFile, []byte(`{{ template "cors.tmpl" . }} {{ template "tls.tmpl" . }}`), 0644)
+	includePaths = stringList{local, shared}
+	defer func() { includePaths = nil }()
+	os.Setenv("APPCONF_CORS_ORIGIN", "*")
+	defer os.Unsetenv("APPCONF_CORS_ORIGIN")
+
+	tpl, err := initializeTemplate()
+	if err != nil {
+		t.Fatalf("Template with includes should be initialized, got %v", err)
+	}
+	config, _ := retrieveEnv(tpl)
+	content, _ := renderTemplate(tpl, config)
+	if string(content) != "local cors * tls" {
+		t.Errorf("Includes should be taken from the first include path, got [%s]", content)
+	}
+}
+
+func TestParseTemplateWithIndent(t *testing.T) {
+	assertParsed(t, "{{ \"a\\nb\" | indent 2 }}", "  a\n  b")
+	assertParsed(t, "key:{{ \"a: 1\\nb: 2\" | nindent 4 }}", "key:\n    a: 1\n    b: 2")
+}
+
+func TestIncludeIsIndented(t *testing.T) {
+	tmpl, _ := prepareTemplate(template.New("test")).Parse(`services:{{ include "service.tmpl" . | nindent 2 }}`)
+	tmpl.New("service.tmpl").Parse("web:\n  image: {{ .VarStandard }}")
+
+	fields := ListTemplFields(tmpl)
+	if !reflect.DeepEqual(fields, []string{"{{.VarStandard}}"}) {
+		t.Errorf("Fields of included templates should be listed, and not the template name, got %v", fields)
+	}
+	content, err := renderTemplate(tmpl, MakeConfig())
+	if err != nil || string(content) != "services:\n  web:\n    image: this_is_a_config_value" {
+		t.Errorf("Included template should be indented, got [%s] %v", content, err)
+	}
+}
+
+func TestIncludeRecursionIsLimited(t *testing.T) {
+	tmpl, _ := prepareTemplate(template.New("test")).Parse(`{{ include "loop.tmpl" . }}`)
+	tmpl.New("loop.tmpl").Parse(`{{ include "loop.tmpl" . }}`)
+	ListTemplFields(tmpl)
+
+	if _, err := renderTemplate(tmpl, MakeConfig()); err == nil || !strings.Contains(err.Error(), "maximum include depth") {
+		t.Errorf("Recursive includes should fail, got %v", err)
+	}
+	if _, err := renderTemplate(template.Must(prepareTemplate(template.New("test")).Parse(`{{ include "none" . }}`)), MakeConfig()); err == nil {
+		t.Error("Including an unknown template should fail")
+	}
+}
+
+func TestInitializeTemplateWithExtends(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "base"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "base", "root.tmpl"), []byte(`server {{ .Fqdn }} {{ block "locations" . }}default{{ end }} {{ block "tls" . }}no tls{{ end }}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "base.tmpl"), []byte(`{{/* extends "base/root.tmpl" */}}{{ define "tls" }}tls {{ .Cert }}{{ end }}`), 0644)
+	*sourceTplFile = filepath.Join(dir, "vhost.tmpl")
+	ioutil.WriteFile(*sourceTplFile, []byte("{{/* extends \"base.tmpl\" */}}\n{{ define \"locations\" }}location {{ .Root }}{{ end }}\n"), 0644)
+	os.Setenv("APPCONF_FQDN", "example.org")
+	os.Setenv("APPCONF_ROOT", "/srv")
+	os.Setenv("APPCONF_CERT", "cert.pem")
+	defer os.Unsetenv("APPCONF_FQDN")
+	defer os.Unsetenv("APPCONF_ROOT")
+	defer os.Unsetenv("APPCONF_CERT")
+
+	tpl, err := initializeTemplate()
+	if err != nil {
+		t.Fatalf("Extending template should be initialized, got %v", err)
+	}
+	config, missing := retrieveEnv(tpl)
+	content, _ := renderTemplate(tpl, config)
+	if string(content) != "server example.org location /srv tls cert.pem" || len(missing) != 0 {
+		t.Errorf("Blocks of extended templates should be overridden, got [%s] missing %v", content, missing)
+	}
+	wantedPaths := []string{*sourceTplFile, filepath.Join(dir, "base.tmpl"), filepath.Join(dir, "base", "root.tmpl")}
+	if paths := watchedPaths(); !reflect.DeepEqual(paths, wantedPaths) {
+		t.Errorf("Extended templates should be watched, want %v, got %v", wantedPaths, paths)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "base", "root.tmpl"), []byte(`{{/* extends "../vhost.tmpl" */}}`), 0644)
+	if _, err := initializeTemplate(); err == nil || !strings.Contains(err.Error(), "circular extends") {
+		t.Errorf("Circular extends should fail, got %v", err)
+	}
+}
+
+func TestParseTemplateWithTpl(t *testing.T) {
+	assertParsed(t, "{{ tpl \"/srv/{{ .VarStandard | upper }}/web\" . }}", "/srv/THIS_IS_A_CONFIG_VALUE/web")
+	assertParsed(t, "{{ tpl \"{{ tpl \\\"{{ .VarBool }}\\\" . }}\" . }}", "true")
+
+	tmpl := template.Must(prepareTemplate(template.New("test")).Parse(`{{ tpl .Self . }}`))
+	if _, err := renderTemplate(tmpl, map[string]interface{}{"Self": "{{ tpl .Self . }}"}); err == nil || !strings.Contains(err.Error(), "maximum include depth") {
+		t.Errorf("Recursive tpl calls should fail, got %v", err)
+	}
+}
+
+func TestRenderValueTemplates(t *testing.T) {
+	values := map[string]string{
+		"APPCONF_ROOT":   "/srv/{{ .Fqdn }}/{{ .Dir }}",
+		"APPCONF_FQDN":   "{{ .Host }}.example.org",
+		"APPCONF_HOST":   "www",
+		"APPCONF_DIR":    "web",
+		"APPCONF_CYCLE":  "{{ .Cycle2 }}",
+		"APPCONF_CYCLE2": "{{ .Cycle }}",
+	}
+	lookup := func(key string) (string, bool) {
+		val, ok := values[key]
+		return val, ok
+	}
+	tmpl := template.Must(prepareTemplate(template.New("test")).Parse(`root {{ .Root }} {{ .Fqdn }}`))
+	config, _ := retrieveValues(tmpl, "APPCONF", lookup)
+	missing, err := renderValueTemplates(tmpl, config, "APPCONF", lookup)
+	content, _ := renderTemplate(tmpl, config)
+	if err != nil || len(missing) != 0 || string(content) != "root /srv/www.example.org/web www.example.org" {
+		t.Errorf("Values should be rendered against the other values, got [%s] %v %v", content, missing, err)
+	}
+
+	tmpl = template.Must(prepareTemplate(template.New("test")).Parse(`{{ .Cycle }}{{ .Unknown }}`))
+	config, _ = retrieveValues(tmpl, "APPCONF", lookup)
+	if _, err := renderValueTemplates(tmpl, config, "APPCONF", lookup); err == nil || err.Error() != "variable APPCONF_CYCLE: circular reference Cycle -> Cycle2 -> Cycle" {
+		t.Errorf("Circular references should fail naming the variable, got %v", err)
+	}
+	values["APPCONF_ROOT"] = "{{ .Missing }}"
+	tmpl = template.Must(prepareTemplate(template.New("test")).Parse(`{{ .Root }}`))
+	config, _ = retrieveValues(tmpl, "APPCONF", lookup)
+	if missing, err := renderValueTemplates(tmpl, config, "APPCONF", lookup); err != nil || !reflect.DeepEqual(missing, []string{"APPCONF_MISSING"}) {
+		t.Errorf("Missing variables of values should be reported, got %v %v", missing, err)
+	}
+	values["APPCONF_ALIASES"] = "{{ .Fqdn }},static.{{ .Fqdn }}"
+	aliases := template.Must(prepareTemplate(template.New("test")).Parse(`{{ range .Aliases }}{{ . }} {{ end }}`))
+	config, _ = retrieveValues(aliases, "APPCONF", lookup)
+	if _, err := renderValueTemplates(aliases, config, "APPCONF", lookup); err != nil || !reflect.DeepEqual(config["Aliases"], []string{"www.example.org", "static.www.example.org"}) {
+		t.Errorf("Values with commas should be rendered before being split into a list, got %v %v", config["Aliases"], err)
+	}
+	values["APPCONF_ROOT"] = "{{ .Fqdn"
+	config, _ = retrieveValues(tmpl, "APPCONF", lookup)
+	if _, err := renderValueTemplates(tmpl, config, "APPCONF", lookup); err == nil || !strings.HasPrefix(err.Error(), "variable APPCONF_ROOT: ") {
+		t.Errorf("Invalid value templates should fail naming the variable, got %v", err)
+	}
+}
+
+func TestInitializeTemplateWithDelims(t *testing.T) {
+	templateDelims.Set("[[ ]]")
+	defer templateDelims.Set("{{ }}")
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "base.tmpl"), []byte(`image: {{ .Values.image }} [[ block "tag" . ]]latest[[ end ]]`), 0644)
+	*sourceTplFile = filepath.Join(dir, "values.tmpl")
+	ioutil.WriteFile(*sourceTplFile, []byte(`[[/* extends "base.tmpl" */]][[ define "tag" ]][[ if .Tag ]][[ .Tag | upper ]][[ end ]][[ end ]]`), 0644)
+	os.Setenv("APPCONF_TAG", "v1")
+	defer os.Unsetenv("APPCONF_TAG")
+
+	tpl, err := initializeTemplate()
+	if err != nil {
+		t.Fatalf("Template with custom delimiters should be initialized, got %v", err)
+	}
+	config, missing := retrieveEnv(tpl)
+	content, _ := renderTemplate(tpl, config)
+	if string(content) != "image: {{ .Values.image }} V1" || len(missing) != 0 {
+		t.Errorf("Custom delimiters should be used, got [%s] missing %v", content, missing)
+	}
+	if err := templateDelims.Set("[["); err == nil {
+		t.Error("Delimiters should be a pair")
+	}
+}
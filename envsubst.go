@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+//envsubstTemplate a source template in the envsubst syntax : $VAR, ${VAR}, and the ${VAR:-default} and ${VAR:?message}
+//forms of -expand. Only the allowed variables are substituted, others such as nginx $host are kept as is
+type envsubstTemplate struct {
+	content string
+	allowed func(string) bool
+}
+
+//Execute write the content with its references substituted by the values of data, a map of env var names
+func (e *envsubstTemplate) Execute(w io.Writer, data interface{}) error {
+	values, _ := data.(map[string]interface{})
+	content, _, err := e.substitute(func(name string) (string, bool) {
+		val, ok := values[name]
+		if !ok {
+			return "", false
+		}
+		if *strictEscape {
+			return escapeValue(val), true
+		}
+		return fmt.Sprint(val), true
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, content)
+	return err
+}
+
+//substitute replace the allowed references of the content with the values given by lookup, and list the variables
+//missing for references without default
+func (e *envsubstTemplate) substitute(lookup func(string) (string, bool)) (string, []string, error) {
+	resolve := func(name string) (string, bool, error) {
+		if !e.allowed(name) {
+			return "", false, nil
+		}
+		val, ok := lookup(name)
+		return val, ok, nil
+	}
+	s := e.content
+	var buf strings.Builder
+	var missing []string
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+		var name, ref string
+		var end int
+		switch c := s[i+1]; {
+		case c == '{':
+			if end = closingBrace(s, i+2); end < 0 {
+				buf.WriteByte(s[i])
+				continue
+			}
+			ref = s[i+2 : end]
+			name = ref[:varNameLen(ref)]
+		case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+			name = s[i+1 : i+1+varNameLen(s[i+1:])]
+			ref, end = name, i+len(name)
+		default:
+			buf.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case !e.allowed(name):
+			buf.WriteString(s[i : end+1])
+		case ref == name:
+			val, ok := lookup(name)
+			if !ok {
+				val = fmt.Sprintf(missingVarStr, name, name)
+				missing = append(missing, name)
+			}
+			buf.WriteString(val)
+		default:
+			val, err := expandReference(ref, resolve)
+			if err != nil {
+				return "", nil, err
+			}
+			buf.WriteString(val)
+		}
+		i = end
+	}
+	return buf.String(), missing, nil
+}
+
+func varNameLen(s string) int {
+	n := 0
+	for n < len(s) && isVarNameChar(s[n]) {
+		n++
+	}
+	return n
+}
+
+//envsubstAllowed the variables substituted by the envsubst engine : those of the allowlist when given,
+//else those with the prefix
+func envsubstAllowed(prefix string, allowlist []string) func(string) bool {
+	return func(name string) bool {
+		if len(allowlist) > 0 {
+			for _, allowed := range allowlist {
+				if allowed == name {
+					return true
+				}
+			}
+			return false
+		}
+		return strings.HasPrefix(name, prefix+"_")
+	}
+}
+
+//prepareEnvsubst read the source template with the envsubst engine and lookup the values it uses
+func prepareEnvsubst() (renderer, map[string]interface{}, []string, error) {
+	content, err := readSourceTemplate()
+	if err != nil {
+		return nil, nil, nil, &exitError{2, fmt.Errorf("Cannot initialize template du to error : %s", err)}
+	}
+	if err := ensureRemoteValues(); err != nil {
+		return nil, nil, nil, &exitError{3, fmt.Errorf("remote values: %s", err)}
+	}
+	t := &envsubstTemplate{content: string(content), allowed: envsubstAllowed(*envPrefix, allowedVars)}
+	lookup, expandErr := expandingLookup(lookupValue)
+	env := make(map[string]interface{})
+	_, missing, err := t.substitute(func(name string) (string, bool) {
+		val, ok := lookup(name)
+		if ok {
+			env[name] = val
+		}
+		return val, ok
+	})
+	if err == nil {
+		err = expandErr()
+	}
+	if err != nil {
+		return nil, nil, nil, &exitError{3, err}
+	}
+	RemoveDuplicates(&missing)
+	return t, env, missing, nil
+}
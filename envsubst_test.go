@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvsubstTemplate(t *testing.T) {
+	tpl := &envsubstTemplate{
+		content: "server_name $NGX_FQDN;\nroot ${NGX_ROOT:-/srv}/${NGX_DIR-web};\nproxy_set_header Host $host$request_uri ${host} $1 $ $NGX_MISSING;\n",
+		allowed: envsubstAllowed("NGX", nil),
+	}
+	var buf strings.Builder
+	err := tpl.Execute(&buf, map[string]interface{}{"NGX_FQDN": "example.org", "NGX_DIR": "", "host": "nope"})
+	expected := "server_name example.org;\nroot /srv/;\nproxy_set_header Host $host$request_uri ${host} $1 $ " +
+		"####### DKCONF : MISSING ENV VAR FOR GO TPL VALUE: NGX_MISSING, SHOULD BE NGX_MISSING #######;\n"
+	if err != nil || buf.String() != expected {
+		t.Errorf("Prefixed variables only should be substituted, got [%s] %v", buf.String(), err)
+	}
+
+	tpl = &envsubstTemplate{content: "$PORT $NGX_FQDN ${WORKERS:?is required}", allowed: envsubstAllowed("NGX", []string{"PORT", "WORKERS"})}
+	_, missing, err := tpl.substitute(func(name string) (string, bool) {
+		return map[string]string{"PORT": "80"}[name], name == "PORT"
+	})
+	if err == nil || err.Error() != "WORKERS: is required" || missing != nil {
+		t.Errorf("Required variables should fail, got %v %v", missing, err)
+	}
+	buf.Reset()
+	tpl.Execute(&buf, map[string]interface{}{"PORT": "80", "NGX_FQDN": "example.org", "WORKERS": "4"})
+	if buf.String() != "80 $NGX_FQDN 4" {
+		t.Errorf("Only the allowlist should be substituted when given, got [%s]", buf.String())
+	}
+}
+
+func TestRenderTargetWithEnvsubstEngine(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	*sourceTplFile = filepath.Join(dir, "vhost.conf")
+	*targetFile = filepath.Join(dir, "target.conf")
+	*engine = "envsubst"
+	defer func() { *targetFile, *engine = "", "go" }()
+	ioutil.WriteFile(*sourceTplFile, []byte("listen $APPCONF_PORT; # $host $APPCONF_UNSET"), 0644)
+	os.Setenv("APPCONF_PORT", "8080")
+	defer os.Unsetenv("APPCONF_PORT")
+
+	result, err := renderTarget()
+	content, _ := ioutil.ReadFile(*targetFile)
+	if err != nil || !result.changed || !strings.HasPrefix(string(content), "listen 8080; # $host ####### DKCONF") {
+		t.Errorf("Target should be rendered with the envsubst engine, got [%s] %v", content, err)
+	}
+	if !reflect.DeepEqual(result.missing, []string{"APPCONF_UNSET"}) {
+		t.Errorf("Missing variables should be reported, got %v", result.missing)
+	}
+
+	*engine = "jinja2"
+	if _, err := renderTarget(); exitCodeOf(err) != 2 {
+		t.Errorf("Unknown engines should fail with code 2, got %v", err)
+	}
+}
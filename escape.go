@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+//formatEscapers escape function of the values of each target format
+var formatEscapers = map[string]string{
+	"nginx":      "nginx_quote",
+	"yaml":       "yaml_quote",
+	"json":       "json_string",
+	"ini":        "ini_value",
+	"toml":       "toml_string",
+	"xml":        "xml_escape",
+	"shell":      "shell_quote",
+	"properties": "properties_value",
+}
+
+//checkFormat check -format and -strict-escape
+func checkFormat() error {
+	if _, ok := formatEscapers[*outputFormat]; !ok && *outputFormat != "" {
+		return fmt.Errorf("unknown format %s", *outputFormat)
+	}
+	if *strictEscape && *outputFormat == "" {
+		return fmt.Errorf("-strict-escape requires -format")
+	}
+	return nil
+}
+
+//isEscapeFunc check if the template function name escapes its value, raw printing it as is
+func isEscapeFunc(name string) bool {
+	if name == "raw" || name == "escape_value" {
+		return true
+	}
+	for _, escaper := range formatEscapers {
+		if escaper == name {
+			return true
+		}
+	}
+	return false
+}
+
+//printedValue v as printed in a template
+func printedValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+//escapeValue escape v for the -format of the target
+func escapeValue(v interface{}) string {
+	switch *outputFormat {
+	case "nginx":
+		return nginxQuote(v)
+	case "yaml", "json", "toml":
+		return quoteString(v)
+	case "ini":
+		return iniValue(v)
+	case "xml":
+		return xmlEscape(v)
+	case "shell":
+		return shellQuote(v)
+	case "properties":
+		return propertiesValue(v)
+	}
+	return printedValue(v)
+}
+
+//quoteString double quoted string, valid in JSON, YAML and TOML
+func quoteString(v interface{}) string {
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for _, r := range printedValue(v) {
+		switch r {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+//shellQuote single quoted shell word
+func shellQuote(v interface{}) string {
+	return "'" + strings.Replace(printedValue(v), "'", `'\''`, -1) + "'"
+}
+
+//xmlEscape XML text or attribute value
+func xmlEscape(v interface{}) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(printedValue(v)))
+	return buf.String()
+}
+
+//nginxQuote nginx parameter, double quoted when it holds spaces or special characters
+func nginxQuote(v interface{}) string {
+	s := printedValue(v)
+	if s != "" && !strings.ContainsAny(s, " \t\r\n;{}\"'\\#") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+//iniValue ini value, double quoted when it holds leading or trailing spaces, quotes, comments or new lines
+func iniValue(v interface{}) string {
+	s := printedValue(v)
+	if strings.TrimSpace(s) == s && !strings.ContainsAny(s, "\"';#=\r\n\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(s) + `"`
+}
+
+//propertiesValue java properties value
+func propertiesValue(v interface{}) string {
+	s := strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`, "=", `\=`, ":", `\:`, "#", `\#`, "!", `\!`).Replace(printedValue(v))
+	if strings.HasPrefix(s, " ") { // leading spaces would be trimmed
+		s = `\` + s
+	}
+	return s
+}
+
+//autoEscape make every action of the templates of t print its value through escape_value, unless it already ends
+//with an escape function or includes a partial, escaping its own values
+func autoEscape(t *template.Template) {
+	for _, associated := range t.Templates() {
+		if associated.Tree != nil {
+			escapeNode(associated.Tree.Root)
+		}
+	}
+}
+
+func escapeNode(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) == 0 && needsEscape(n.Pipe) {
+			escaper := &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos, Args: []parse.Node{parse.NewIdentifier("escape_value").SetPos(n.Pos)}}
+			n.Pipe.Cmds = append(n.Pipe.Cmds, escaper)
+		}
+	case *parse.IfNode:
+		escapeBranches(n.List, n.ElseList)
+	case *parse.RangeNode:
+		escapeBranches(n.List, n.ElseList)
+	case *parse.WithNode:
+		escapeBranches(n.List, n.ElseList)
+	case *parse.ListNode:
+		for _, child := range n.Nodes {
+			escapeNode(child)
+		}
+	}
+}
+
+func escapeBranches(list *parse.ListNode, elseList *parse.ListNode) {
+	escapeNode(list)
+	if elseList != nil {
+		escapeNode(elseList)
+	}
+}
+
+func needsEscape(pipe *parse.PipeNode) bool {
+	for i, cmd := range pipe.Cmds {
+		if ident, ok := cmd.Args[0].(*parse.IdentifierNode); ok {
+			if ident.Ident == "include" || i == len(pipe.Cmds)-1 && isEscapeFunc(ident.Ident) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestEscapeFunctions(t *testing.T) {
+	value := "it's a \"value\": \\ # ;\n"
+	for name, expected := range map[string]string{
+		"yaml_quote":       `"it's a \"value\": \\ # ;\n"`,
+		"json_string":      `"it's a \"value\": \\ # ;\n"`,
+		"shell_quote":      `'it'\''s a "value": \ # ;` + "\n'",
+		"xml_escape":       "it&#39;s a &#34;value&#34;: \\ # ;&#xA;",
+		"ini_value":        `"it's a \"value\": \\ # ;\n"`,
+		"nginx_quote":      `"it's a \"value\": \\ # ;` + "\n\"",
+		"properties_value": `it's a "value"\: \\ \# ;\n`,
+	} {
+		assertParsed(t, "{{ \""+strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)+"\" | "+name+" }}", expected)
+	}
+	assertParsed(t, "{{ .VarStandard | nginx_quote }} {{ .VarStandard | ini_value }} {{ \" a\" | properties_value }}", "this_is_a_config_value this_is_a_config_value \\ a")
+	assertParsed(t, "{{ \"\\x01\" | json_string }} {{ \"\" | nginx_quote }}", `"\u0001" ""`)
+}
+
+func TestAutoEscape(t *testing.T) {
+	*outputFormat = "yaml"
+	defer func() { *outputFormat = "" }()
+	tmpl := template.Must(prepareTemplate(template.New("test")).Parse(
+		`a: {{ .A }}{{ $b := .B }}{{ if .B }} b: {{ $b | upper }}{{ else }}{{ end }}{{ range .L }} - {{ . }}{{ end }} raw: {{ .A | raw }} ` +
+			`q: {{ shell_quote .A }} {{ include "part" . }}{{ template "part" . }}`))
+	template.Must(tmpl.New("part").Parse(`p: {{ .A }}`))
+	autoEscape(tmpl)
+
+	content, err := renderTemplate(tmpl, map[string]interface{}{"A": "x: y", "B": "b", "L": []string{"#1"}})
+	expected := `a: "x: y" b: "B" - "#1" raw: x: y q: 'x: y' p: "x: y"p: "x: y"`
+	if err != nil || string(content) != expected {
+		t.Errorf("Printed values should be escaped once, got [%s] %v", content, err)
+	}
+}
+
+func TestRenderTargetWithStrictEscape(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	*sourceTplFile = filepath.Join(dir, "app.yaml.tmpl")
+	*targetFile = filepath.Join(dir, "app.yaml")
+	*outputFormat, *strictEscape = "yaml", true
+	defer func() { *targetFile, *outputFormat, *strictEscape, *engine = "", "", false, "go" }()
+	os.Setenv("APPCONF_TITLE", "a: b")
+	defer os.Unsetenv("APPCONF_TITLE")
+
+	for engineName, source := range map[string]string{"go": "title: {{ .Title }}", "jinja": "title: {{ title }}", "envsubst": "title: $APPCONF_TITLE"} {
+		*engine = engineName
+		ioutil.WriteFile(*sourceTplFile, []byte(source), 0644)
+		if _, err := renderTarget(); err != nil {
+			t.Fatalf("Target should be rendered with the %s engine, got %v", engineName, err)
+		}
+		if content, _ := ioutil.ReadFile(*targetFile); string(content) != `title: "a: b"` {
+			t.Errorf("Values should be escaped with the %s engine, got [%s]", engineName, content)
+		}
+	}
+
+	*outputFormat = "csv"
+	if _, err := renderTarget(); exitCodeOf(err) != 2 {
+		t.Errorf("Unknown formats should fail with code 2, got %v", err)
+	}
+	*outputFormat = ""
+	if _, err := renderTarget(); exitCodeOf(err) != 2 {
+		t.Errorf("Strict escaping without format should fail with code 2, got %v", err)
+	}
+}
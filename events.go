@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	eventTimeout = 5 * time.Second
+)
+
+//renderEvent the JSON event sent after each rendering
+type renderEvent struct {
+	Template string    `json:"template"`
+	Target   string    `json:"target"`
+	Checksum string    `json:"checksum,omitempty"`
+	Changed  bool      `json:"changed"`
+	Missing  []string  `json:"missing"`
+	Duration float64   `json:"duration_seconds"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+//newRenderEvent build the event of a rendering
+func newRenderEvent(result renderResult, err error) renderEvent {
+	event := renderEvent{
+		Template: templateName(),
+		Target:   *targetFile,
+		Checksum: result.checksum,
+		Changed:  result.changed,
+		Missing:  result.missing,
+		Duration: result.duration.Seconds(),
+		Time:     time.Now().UTC(),
+	}
+	if event.Missing == nil {
+		event.Missing = []string{}
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return event
+}
+
+//sendRenderEvent post the event of a rendering to the webhook and write it to the event socket,
+//failures are logged but never fail the rendering
+func sendRenderEvent(result renderResult, err error) {
+	if *webhookURL == "" && *eventSocket == "" {
+		return
+	}
+	payload, jerr := json.Marshal(newRenderEvent(result, err))
+	if jerr != nil {
+		log.Print("event: ", jerr)
+		return
+	}
+	if *webhookURL != "" {
+		if err := postEvent(*webhookURL, payload); err != nil {
+			log.Print("webhook: ", err)
+		}
+	}
+	if *eventSocket != "" {
+		if err := writeEvent(*eventSocket, payload); err != nil {
+			log.Print("event socket: ", err)
+		}
+	}
+}
+
+//postEvent post payload to url
+func postEvent(url string, payload []byte) error {
+	client := http.Client{Timeout: eventTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+//writeEvent write payload as a line to the unix socket at path
+func writeEvent(path string, payload []byte) error {
+	conn, err := net.DialTimeout("unix", path, eventTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(eventTimeout))
+	_, err = conn.Write(append(payload, '\n'))
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenderEventWebhook(t *testing.T) {
+	events := make(chan renderEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event renderEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer server.Close()
+	*webhookURL = server.URL
+	*targetFile = "/etc/nginx/nginx.conf"
+	defer func() { *webhookURL, *targetFile = "", "" }()
+
+	sendRenderEvent(renderResult{changed: true, checksum: "abcd", missing: []string{"APPCONF_A"}, duration: time.Second}, nil)
+
+	event := <-events
+	if event.Target != "/etc/nginx/nginx.conf" || !event.Changed || event.Checksum != "abcd" || event.Duration != 1 || len(event.Missing) != 1 || event.Error != "" {
+		t.Errorf("Event is not the one waited, got %+v", event)
+	}
+}
+
+func TestRenderEventSocket(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	*eventSocket = filepath.Join(dir, "events.sock")
+	defer func() { *eventSocket = "" }()
+	l, err := net.Listen("unix", *eventSocket)
+	if err != nil {
+		t.Fatalf("Cannot listen on %s: %s", *eventSocket, err)
+	}
+	defer l.Close()
+
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		lines <- line
+	}()
+
+	sendRenderEvent(renderResult{}, errors.New("boom"))
+
+	var event renderEvent
+	json.Unmarshal([]byte(<-lines), &event)
+	if event.Error != "boom" || event.Changed || event.Missing == nil {
+		t.Errorf("Event is not the one waited, got %+v", event)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+//execCommand replace the dkconf process by the given command, looked up in PATH, so it keeps its pid and signals
+func execCommand(args []string) error {
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, args, os.Environ())
+}
+
+//renderThenExec render the target then, with args, replace dkconf by the command with exec,
+//which is not called when the rendering failed
+func renderThenExec(args []string, exec func(args []string) error) (renderResult, error) {
+	result, err := renderOnce()
+	if err != nil || len(args) == 0 {
+		return result, err
+	}
+	if err := exec(args); err != nil {
+		return result, &exitError{6, fmt.Errorf("exec: %s", err)}
+	}
+	return result, nil
+}
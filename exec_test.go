@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExecCommandNotFound(t *testing.T) {
+	if err := execCommand([]string{"dkconf-command-that-does-not-exist"}); err == nil {
+		t.Error("Exec of an unknown command should fail")
+	}
+}
+
+func TestRenderThenExec(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	source, target := filepath.Join(dir, "app.tmpl"), filepath.Join(dir, "app.conf")
+	ioutil.WriteFile(source, []byte("listen {{ .Port }}"), 0644)
+	os.Setenv("APPCONF_PORT", "80")
+	defer os.Unsetenv("APPCONF_PORT")
+
+	args := os.Args
+	os.Args = []string{"dkconf", "-s", source, "-t", target, "--", "nginx", "-g", "daemon off;"}
+	defer func() {
+		os.Args = args
+		*sourceTplFile, *targetFile = "", ""
+	}()
+	parseCommandLine()
+
+	var execArgs []string
+	var rendered string
+	fakeExec := func(args []string) error {
+		content, _ := ioutil.ReadFile(target)
+		execArgs, rendered = args, string(content)
+		return nil
+	}
+	if _, err := renderThenExec(flag.Args(), fakeExec); err != nil {
+		t.Fatalf("Target should be rendered, got %v", err)
+	}
+	if !reflect.DeepEqual(execArgs, []string{"nginx", "-g", "daemon off;"}) {
+		t.Errorf("The command after -- should be executed, got %v", execArgs)
+	}
+	if rendered != "listen 80" {
+		t.Errorf("The target should be rendered before the exec, got [%s]", rendered)
+	}
+
+	execArgs = nil
+	ioutil.WriteFile(source, []byte("listen {{ .Port "), 0644)
+	if _, err := renderThenExec(flag.Args(), fakeExec); err == nil || execArgs != nil {
+		t.Errorf("The command should not be executed when the rendering fails, got %v exec %v", err, execArgs)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//expander expand the ${VAR}, ${VAR:-default} and ${VAR:?message} references in the values returned by lookup,
+//the referenced variables are looked up with lookup and expanded first
+type expander struct {
+	lookup    func(string) (string, bool)
+	expanding map[string]bool
+	err       error
+}
+
+func newExpander(lookup func(string) (string, bool)) *expander {
+	return &expander{lookup: lookup, expanding: make(map[string]bool)}
+}
+
+//expandingLookup wrap lookup to expand the values with -expand, the returned function giving the first expansion error
+func expandingLookup(lookup func(string) (string, bool)) (func(string) (string, bool), func() error) {
+	if !*expandVars {
+		return lookup, func() error { return nil }
+	}
+	e := newExpander(lookup)
+	return e.Lookup, func() error { return e.err }
+}
+
+//Lookup lookup key and expand its value, the first expansion error is kept in err and the raw value returned
+func (e *expander) Lookup(key string) (string, bool) {
+	val, ok, err := e.resolve(key)
+	if err != nil {
+		if e.err == nil {
+			e.err = err
+		}
+		return e.lookup(key)
+	}
+	return val, ok
+}
+
+func (e *expander) resolve(key string) (string, bool, error) {
+	val, ok := e.lookup(key)
+	if !ok {
+		return "", false, nil
+	}
+	if e.expanding[key] {
+		return "", true, fmt.Errorf("%s: circular reference", key)
+	}
+	e.expanding[key] = true
+	defer delete(e.expanding, key)
+	val, err := expandString(val, e.resolve)
+	if err != nil {
+		return "", true, fmt.Errorf("%s: %s", key, err)
+	}
+	return val, true, nil
+}
+
+//expandString replace the ${...} references of s with the values given by resolve, $$ being a literal $
+func expandString(s string, resolve func(string) (string, bool, error)) (string, error) {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			buf.WriteByte('$')
+			i++
+		case '{':
+			end := closingBrace(s, i+2)
+			if end < 0 {
+				return "", fmt.Errorf("unterminated reference %s", s[i:])
+			}
+			val, err := expandReference(s[i+2:end], resolve)
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString(val)
+			i = end
+		default:
+			buf.WriteByte('$')
+		}
+	}
+	return buf.String(), nil
+}
+
+//closingBrace index of the brace closing the reference starting at start, nested references included
+func closingBrace(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			depth++
+			i++
+		case s[i] == '}' && depth == 0:
+			return i
+		case s[i] == '}':
+			depth--
+		}
+	}
+	return -1
+}
+
+//expandReference expand the content of a ${...} reference: a variable name, optionally followed by
+//:-default or -default, used when it is unset (or empty with the colon), or by :?message or ?message, failing then
+func expandReference(ref string, resolve func(string) (string, bool, error)) (string, error) {
+	n := varNameLen(ref)
+	name, op := ref[:n], ref[n:]
+	if name == "" {
+		return "", fmt.Errorf("bad substitution ${%s}", ref)
+	}
+	val, ok, err := resolve(name)
+	if err != nil {
+		return "", err
+	}
+	nullable := strings.HasPrefix(op, ":")
+	unset := !ok || (nullable && val == "")
+	switch op = strings.TrimPrefix(op, ":"); {
+	case op == "" && !nullable:
+		return val, nil
+	case strings.HasPrefix(op, "-"):
+		if unset {
+			return expandString(op[1:], resolve)
+		}
+		return val, nil
+	case strings.HasPrefix(op, "?"):
+		if !unset {
+			return val, nil
+		}
+		message, err := expandString(op[1:], resolve)
+		if err != nil {
+			return "", err
+		}
+		if message == "" {
+			message = "parameter null or not set"
+		}
+		return "", errors.New(name + ": " + message)
+	}
+	return "", fmt.Errorf("bad substitution ${%s}", ref)
+}
+
+func isVarNameChar(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
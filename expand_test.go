@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"text/template"
+)
+
+func TestExpanderLookup(t *testing.T) {
+	values := map[string]string{
+		"APPCONF_BASE_DIR": "/srv/${APPCONF_NAME}",
+		"APPCONF_NAME":     "app",
+		"APPCONF_EMPTY":    "",
+		"APPCONF_LOG_DIR":  "${APPCONF_BASE_DIR}/logs",
+		"APPCONF_DEFAULTS": "${APPCONF_UNSET:-${APPCONF_NAME}-default} ${APPCONF_EMPTY:-empty} ${APPCONF_EMPTY-unset} ${APPCONF_UNSET}",
+		"APPCONF_PRICE":    "$$5 $host",
+		"APPCONF_REQUIRED": "${APPCONF_EMPTY:?must be set}",
+		"APPCONF_CYCLE":    "${APPCONF_CYCLE2}",
+		"APPCONF_CYCLE2":   "a${APPCONF_CYCLE}",
+		"APPCONF_BAD":      "${APPCONF_NAME",
+	}
+	lookup := func(key string) (string, bool) {
+		val, ok := values[key]
+		return val, ok
+	}
+	for key, expected := range map[string]string{
+		"APPCONF_LOG_DIR":  "/srv/app/logs",
+		"APPCONF_DEFAULTS": "app-default empty  ",
+		"APPCONF_PRICE":    "$5 $host",
+	} {
+		e := newExpander(lookup)
+		if val, ok := e.Lookup(key); !ok || val != expected || e.err != nil {
+			t.Errorf("%s should be expanded into [%s], got [%s] %v", key, expected, val, e.err)
+		}
+	}
+
+	for key, expected := range map[string]string{
+		"APPCONF_REQUIRED": "APPCONF_REQUIRED: APPCONF_EMPTY: must be set",
+		"APPCONF_CYCLE":    "APPCONF_CYCLE: APPCONF_CYCLE2: APPCONF_CYCLE: circular reference",
+		"APPCONF_BAD":      "APPCONF_BAD: unterminated reference ${APPCONF_NAME",
+	} {
+		e := newExpander(lookup)
+		if val, _ := e.Lookup(key); e.err == nil || e.err.Error() != expected || val != values[key] {
+			t.Errorf("%s expansion should fail with [%s], got [%s] %v", key, expected, val, e.err)
+		}
+	}
+
+	if _, ok := newExpander(lookup).Lookup("APPCONF_UNSET"); ok {
+		t.Error("Unset variables should stay unset")
+	}
+}
+
+func TestRetrieveExpandedValues(t *testing.T) {
+	*expandVars = true
+	defer func() { *expandVars = false }()
+	lookup := func(key string) (string, bool) {
+		val, ok := map[string]string{"APPCONF_DIRS": "${APPCONF_BASE:-/srv}/a,${APPCONF_BASE:-/srv}/b"}[key]
+		return val, ok
+	}
+	tmpl := template.Must(prepareTemplate(template.New("test")).Parse(`{{ range .Dirs }}{{ . }} {{ end }}{{ .Missing }}`))
+	config, missing, err := retrieveExpandedValues(tmpl, "APPCONF", lookup)
+	content, _ := renderTemplate(tmpl, config)
+	if err != nil || len(missing) != 1 || string(content)[:14] != "/srv/a /srv/b " {
+		t.Errorf("Expanded values should be used, got [%s] %v %v", content, missing, err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//cacheMeta validators of a cached remote template
+type cacheMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+//isRemoteSource check if the source template is an http(s) url
+func isRemoteSource(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+//sourceName name of the template parsed from src, the base name of the file or of the url path
+func sourceName(src string) string {
+	if isRemoteSource(src) {
+		if u, err := url.Parse(src); err == nil {
+			return path.Base(u.Path)
+		}
+	}
+	return filepath.Base(src)
+}
+
+//pinnedChecksum look for the checksum of src in the checksums file, in the sha256sum format
+func pinnedChecksum(src string) (string, error) {
+	if *checksumsFile == "" {
+		return "", nil
+	}
+	content, err := ioutil.ReadFile(*checksumsFile)
+	if err != nil {
+		return "", err
+	}
+	name := sourceName(src)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s in %s", name, *checksumsFile)
+}
+
+//resolveSource return the local path of the source template, fetching remote ones, and check its pinned checksum
+//and its signature
+func resolveSource(src string, pinned string) (string, error) {
+	local := src
+	if isRemoteSource(src) {
+		var err error
+		if local, err = fetchTemplate(src, pinned); err != nil {
+			return "", err
+		}
+	}
+	if pinned != "" {
+		if sum := fileChecksum(local); !strings.EqualFold(sum, pinned) {
+			return "", fmt.Errorf("checksum mismatch for %s: got %s, pinned %s", src, sum, pinned)
+		}
+	}
+	if *verifyKey != "" {
+		if err := verifySource(src, local); err != nil {
+			return "", err
+		}
+	}
+	return local, nil
+}
+
+//templateCacheDir directory where the remote templates are cached
+func templateCacheDir() string {
+	if *cacheDir != "" {
+		return *cacheDir
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "dkconf")
+	}
+	return filepath.Join(os.TempDir(), "dkconf-cache")
+}
+
+//cachedTemplate path of the cached copy of the template at rawurl
+func cachedTemplate(rawurl string) string {
+	return filepath.Join(templateCacheDir(), fmt.Sprintf("%x", sha256.Sum256([]byte(rawurl))))
+}
+
+//fetchTemplate fetch the template at rawurl into the cache with a conditional request and return its cached path,
+//the cached copy is used when the server cannot be reached
+func fetchTemplate(rawurl string, pinned string) (string, error) {
+	dir := templateCacheDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	cached := cachedTemplate(rawurl)
+	metaPath := cached + ".json"
+	hasCache := checkFileExists(cached)
+
+	var meta cacheMeta
+	if content, err := ioutil.ReadFile(metaPath); err == nil && hasCache {
+		json.Unmarshal(content, &meta)
+	}
+	fallback := func(err error) (string, error) {
+		if !hasCache {
+			return "", err
+		}
+		log.Printf("fetch %s: %s, using cached copy", rawurl, err)
+		return cached, nil
+	}
+
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return "", err
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+	client := http.Client{Timeout: *fetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fallback(err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && hasCache:
+		return cached, nil
+	case resp.StatusCode != http.StatusOK:
+		return fallback(fmt.Errorf("%s", resp.Status))
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fallback(err)
+	}
+	if pinned != "" { // a tampered template never replaces the cached copy
+		if sum := fmt.Sprintf("%x", sha256.Sum256(content)); !strings.EqualFold(sum, pinned) {
+			return fallback(fmt.Errorf("checksum mismatch: got %s, pinned %s", sum, pinned))
+		}
+	}
+	if err := replaceFile(cached, content); err != nil {
+		return fallback(err)
+	}
+	meta = cacheMeta{URL: rawurl, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	if content, err := json.Marshal(meta); err == nil {
+		replaceFile(metaPath, content)
+	}
+	return cached, nil
+}
+
+//pollRemoteSource fetch the remote source template every interval until stop is closed, refreshing its cached copy
+//which is fingerprinted by the watch loop, errors are retried with an exponential backoff
+func pollRemoteSource(stop <-chan struct{}) {
+	var backoff time.Duration
+	for {
+		delay := jitter(*fetchInterval)
+		if backoff > 0 {
+			delay = backoff
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+
+		if _, err := readSourceTemplate(); err != nil {
+			backoff = nextBackoff(backoff)
+			log.Printf("remote source: %s, retrying in %s", err, backoff)
+			continue
+		}
+		backoff = 0
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSourceName(t *testing.T) {
+	for src, wanted := range map[string]string{
+		"/etc/dkconf/nginx.tmpl":                    "nginx.tmpl",
+		"https://config.internal/nginx.tmpl?ref=v1": "nginx.tmpl",
+	} {
+		if name := sourceName(src); name != wanted {
+			t.Errorf("Name of %s should be %s, got %s", src, wanted, name)
+		}
+	}
+}
+
+func TestFetchTemplateWithCache(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	*cacheDir = dir
+	defer func() { *cacheDir = "" }()
+
+	requests, conditional, down := 0, 0, false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if down {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, "{{ .Fqdn }}")
+	}))
+	defer server.Close()
+	src := server.URL + "/nginx.tmpl"
+
+	path, err := resolveSource(src, "")
+	if err != nil {
+		t.Fatalf("Fetch should succeed, got %v", err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "{{ .Fqdn }}" {
+		t.Errorf("Cached template is not the one served, got [%s]", content)
+	}
+
+	if _, err := resolveSource(src, ""); err != nil || conditional != 1 {
+		t.Errorf("Second fetch should be conditional, got %d conditional requests (%v)", conditional, err)
+	}
+
+	down = true
+	if cached, err := resolveSource(src, ""); err != nil || cached != path {
+		t.Errorf("Cached copy should be used when the server is down, got %s (%v)", cached, err)
+	}
+	if _, err := resolveSource(server.URL+"/other.tmpl", ""); err == nil {
+		t.Error("Fetch without cached copy should fail when the server is down")
+	}
+}
+
+func TestResolveSourcePinnedChecksum(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nginx.tmpl")
+	ioutil.WriteFile(path, []byte("{{ .Fqdn }}"), 0644)
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte("{{ .Fqdn }}")))
+
+	if _, err := resolveSource(path, sum); err != nil {
+		t.Errorf("Pinned checksum should match, got %v", err)
+	}
+	if _, err := resolveSource(path, "0000"); err == nil {
+		t.Error("Checksum mismatch should be refused")
+	}
+}
+
+func TestPinnedChecksum(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	*checksumsFile = filepath.Join(dir, "SHA256SUMS")
+	defer func() { *checksumsFile = "" }()
+	ioutil.WriteFile(*checksumsFile, []byte("abcd  nginx.tmpl\nef01 *cors.tmpl\n"), 0644)
+
+	if sum, err := pinnedChecksum("https://config.internal/cors.tmpl"); err != nil || sum != "ef01" {
+		t.Errorf("Checksum of cors.tmpl should be ef01, got %s (%v)", sum, err)
+	}
+	if _, err := pinnedChecksum("/etc/dkconf/unknown.tmpl"); err == nil {
+		t.Error("Template missing from the checksums file should be refused")
+	}
+}
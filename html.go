@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+//htmlMode check if the values are escaped contextually, with -html or for an html target without -html=false
+func htmlMode() bool {
+	if htmlOutput.set {
+		return htmlOutput.value
+	}
+	switch strings.ToLower(filepath.Ext(*targetFile)) {
+	case ".html", ".htm":
+		return true
+	}
+	return false
+}
+
+//htmlTemplate build an html/template from the templates parsed with t, with the same functions,
+//the values being escaped according to their HTML, JS, CSS or URL context when it is executed
+func htmlTemplate(t *template.Template) (*htmltemplate.Template, error) {
+	includeDepth := 0 // nesting of include and tpl calls
+	return newHTMLTemplate(t, &includeDepth)
+}
+
+//newHTMLTemplate build the html/template of t, include and tpl rendering their templates with html/template too,
+//their output being inserted as HTML rather than escaped as text
+func newHTMLTemplate(t *template.Template, includeDepth *int) (*htmltemplate.Template, error) {
+	h := htmltemplate.New(t.Name())
+	funcs := htmltemplate.FuncMap(templateFuncs(t, envvalue, globalenvvalue))
+	funcs["include"] = func(name string, data interface{}) (htmltemplate.HTML, error) {
+		included := h.Lookup(name)
+		if included == nil {
+			return "", fmt.Errorf("include: no template %q", name)
+		}
+		if *includeDepth >= maxIncludeDepth {
+			return "", fmt.Errorf("include %s: maximum include depth of %d exceeded", name, maxIncludeDepth)
+		}
+		*includeDepth++
+		defer func() { *includeDepth-- }()
+		var buf strings.Builder
+		err := included.Execute(&buf, data)
+		return htmltemplate.HTML(buf.String()), err
+	}
+	funcs["tpl"] = func(v string, data interface{}) (htmltemplate.HTML, error) {
+		if *includeDepth >= maxIncludeDepth {
+			return "", fmt.Errorf("tpl: maximum include depth of %d exceeded", maxIncludeDepth)
+		}
+		*includeDepth++
+		defer func() { *includeDepth-- }()
+		value, err := t.New("tpl").Parse(v)
+		if err != nil {
+			return "", err
+		}
+		hv, err := newHTMLTemplate(value, includeDepth) // h cannot get new templates once executed
+		if err != nil {
+			return "", err
+		}
+		var buf strings.Builder
+		err = hv.Execute(&buf, data)
+		return htmltemplate.HTML(buf.String()), err
+	}
+	h.Funcs(funcs)
+	for _, associated := range t.Templates() {
+		if associated.Tree == nil {
+			continue
+		}
+		if _, err := h.AddParseTree(associated.Name(), associated.Tree.Copy()); err != nil {
+			return nil, err
+		}
+	}
+	return h.Lookup(t.Name()), nil // the template holding the tree of t
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderTargetWithHTMLEscaping(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	*sourceTplFile = filepath.Join(dir, "maintenance.tmpl")
+	defer func() { *targetFile = "" }()
+	ioutil.WriteFile(*sourceTplFile, []byte(`<a href="/status?q={{ .Query }}">{{ .Title | upper }}</a><script>var title = {{ .Title }};</script>`), 0644)
+	os.Setenv("APPCONF_TITLE", `<b>"down"</b>`)
+	os.Setenv("APPCONF_QUERY", "a b&c")
+	defer os.Unsetenv("APPCONF_TITLE")
+	defer os.Unsetenv("APPCONF_QUERY")
+
+	*targetFile = filepath.Join(dir, "index.html")
+	if _, err := renderTarget(); err != nil {
+		t.Fatalf("HTML target should be rendered, got %v", err)
+	}
+	content, _ := ioutil.ReadFile(*targetFile)
+	expected := `<a href="/status?q=a%20b%26c">&lt;B&gt;&#34;DOWN&#34;&lt;/B&gt;</a><script>var title = "\u003cb\u003e\"down\"\u003c/b\u003e";</script>`
+	if string(content) != expected {
+		t.Errorf("Values should be escaped according to their context, got [%s]", content)
+	}
+
+	*targetFile = filepath.Join(dir, "index.conf")
+	renderTarget()
+	content, _ = ioutil.ReadFile(*targetFile)
+	if string(content) != `<a href="/status?q=a b&c"><B>"DOWN"</B></a><script>var title = <b>"down"</b>;</script>` {
+		t.Errorf("Values should not be escaped for other targets, got [%s]", content)
+	}
+
+	*targetFile = filepath.Join(dir, "index.html")
+	htmlOutput.Set("false") // -html=false
+	defer func() { htmlOutput = optionalBool{} }()
+	renderTarget()
+	content, _ = ioutil.ReadFile(*targetFile)
+	if string(content) != `<a href="/status?q=a b&c"><B>"DOWN"</B></a><script>var title = <b>"down"</b>;</script>` {
+		t.Errorf("Values should not be escaped for html targets with -html=false, got [%s]", content)
+	}
+}
+
+func TestRenderTargetWithHTMLIncludes(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "nav.tmpl"), []byte(`<nav>{{ .Title }}</nav>`), 0644)
+	includePaths = stringList{dir}
+	defer func() { includePaths = nil }()
+	*sourceTplFile = filepath.Join(dir, "index.tmpl")
+	ioutil.WriteFile(*sourceTplFile, []byte(`{{ include "nav.tmpl" . }}{{ tpl "<h1>{{ .Title }}</h1>" . }}`), 0644)
+	*targetFile = filepath.Join(dir, "index.html")
+	defer func() { *targetFile = "" }()
+	os.Setenv("APPCONF_TITLE", "<b>x</b>")
+	defer os.Unsetenv("APPCONF_TITLE")
+
+	if _, err := renderTarget(); err != nil {
+		t.Fatalf("HTML target with includes should be rendered, got %v", err)
+	}
+	content, _ := ioutil.ReadFile(*targetFile)
+	if string(content) != `<nav>&lt;b&gt;x&lt;/b&gt;</nav><h1>&lt;b&gt;x&lt;/b&gt;</h1>` {
+		t.Errorf("Included templates should be rendered as HTML, their values being escaped, got [%s]", content)
+	}
+}
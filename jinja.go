@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/nikolalohinski/gonja"
+	"github.com/nikolalohinski/gonja/config"
+	"github.com/nikolalohinski/gonja/exec"
+	"github.com/nikolalohinski/gonja/tokens"
+)
+
+// -engine jinja renders the source template with gonja, a Jinja2 implementation, without the first new line after
+// a statement like Ansible. The dkconf template functions are global functions, and filters called with the filtered
+// value as first argument when Jinja2 has no filter of the same name
+
+//jinjaTemplate a parsed jinja source template
+type jinjaTemplate struct {
+	name    string
+	tpl     *exec.Template
+	fields  []string        // variables used by the template, in order
+	missing map[string]bool // variables without value, undefined in the template
+}
+
+//jinjaInsert a text inserted in the source of a template, before its byte pos
+type jinjaInsert struct {
+	pos  int
+	text string
+}
+
+//jinjaLoader refuse the templates included, imported or extended, whose variables would not be looked up
+type jinjaLoader struct{}
+
+func (jinjaLoader) Get(path string) (io.Reader, error) {
+	return nil, fmt.Errorf("cannot load %s, includes are not supported by the jinja engine", path)
+}
+
+func (jinjaLoader) Path(path string) (string, error) {
+	return path, nil
+}
+
+//jinjaKeywords names of the jinja expressions which are not variables
+var jinjaKeywords = map[string]bool{
+	"if": true, "else": true, "true": true, "false": true, "none": true, "True": true, "False": true, "None": true,
+	"recursive": true, "loop": true,
+}
+
+//jinjaDeclarations statements whose names are not variables
+var jinjaDeclarations = map[string]bool{
+	"block": true, "endblock": true, "endmacro": true, "filter": true, "import": true, "from": true,
+}
+
+//parseJinja parse the jinja template content, funcs being its filters and global functions
+func parseJinja(name string, content string, funcs template.FuncMap) (*jinjaTemplate, error) {
+	env := gonja.NewEnvironment(config.NewConfig(), jinjaLoader{})
+	for name, fn := range funcs {
+		if name == "include" || name == "tpl" { // they render Go templates
+			continue
+		}
+		env.Globals.Set(name, jinjaFunction(name, fn))
+		if !env.Filters.Exists(name) {
+			env.Filters.Register(name, jinjaFilter(name, fn, false))
+		}
+	}
+	env.Filters.Replace("indent", jinjaIndent)
+	env.Filters.Replace("nindent", jinjaFilter("nindent", funcs["nindent"], true))
+
+	toks := lexJinja(content)
+	inserts := trimBlocks(toks)
+	if *strictEscape {
+		inserts = append(inserts, escapeJinja(toks)...)
+	}
+	tpl, err := env.FromString(insertJinja(content, inserts))
+	if err != nil {
+		return nil, err
+	}
+	return &jinjaTemplate{name: name, tpl: tpl, fields: jinjaFields(toks), missing: make(map[string]bool)}, nil
+}
+
+//Execute render the template with data, a map of the variables values, the missing ones being left undefined
+func (t *jinjaTemplate) Execute(w io.Writer, data interface{}) error {
+	values, _ := data.(map[string]interface{})
+	ctx := make(map[string]interface{})
+	for name, val := range values {
+		if !t.missing[name] {
+			ctx[name] = val
+		}
+	}
+	out, err := t.tpl.Execute(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %s", t.name, err)
+	}
+	_, err = io.WriteString(w, out)
+	return err
+}
+
+//lexJinja split the template content into tokens
+func lexJinja(content string) []*tokens.Token {
+	l := tokens.NewLexer(content)
+	go l.Run()
+	var toks []*tokens.Token
+	for tok := range l.Tokens {
+		toks = append(toks, tok)
+	}
+	return toks
+}
+
+//trimBlocks remove the first new line after each statement like Ansible, putting it in a comment so that
+//the errors keep their line
+func trimBlocks(toks []*tokens.Token) []jinjaInsert {
+	var inserts []jinjaInsert
+	stmt := ""
+	for i, tok := range toks {
+		switch {
+		case i == 0:
+		case tok.Type == tokens.Name && (toks[i-1].Type == tokens.BlockBegin || toks[i-1].Type == tokens.Whitespace && toks[i-2].Type == tokens.BlockBegin):
+			stmt = tok.Val
+		case tok.Type == tokens.Data && toks[i-1].Type == tokens.BlockEnd && !strings.HasPrefix(toks[i-1].Val, "-") && stmt != "raw":
+			for _, newline := range []string{"\n", "\r\n"} {
+				if strings.HasPrefix(tok.Val, newline) {
+					inserts = append(inserts, jinjaInsert{tok.Pos, "{#"}, jinjaInsert{tok.Pos + len(newline), "#}"})
+				}
+			}
+		}
+	}
+	return inserts
+}
+
+//insertJinja insert texts in the source of a template
+func insertJinja(content string, inserts []jinjaInsert) string {
+	sort.SliceStable(inserts, func(i, j int) bool { return inserts[i].pos < inserts[j].pos })
+	var buf strings.Builder
+	last := 0
+	for _, insert := range inserts {
+		buf.WriteString(content[last:insert.pos])
+		buf.WriteString(insert.text)
+		last = insert.pos
+	}
+	buf.WriteString(content[last:])
+	return buf.String()
+}
+
+//jinjaTags the tokens of each expression and statement of a template, from their opening delimiter, whitespaces excepted
+func jinjaTags(toks []*tokens.Token) [][]*tokens.Token {
+	var tags [][]*tokens.Token
+	var tag []*tokens.Token
+	for _, tok := range toks {
+		switch tok.Type {
+		case tokens.VariableBegin, tokens.BlockBegin:
+			tag = []*tokens.Token{tok}
+		case tokens.VariableEnd, tokens.BlockEnd:
+			tags = append(tags, tag)
+			tag = nil
+		case tokens.Whitespace:
+		default:
+			if tag != nil {
+				tag = append(tag, tok)
+			}
+		}
+	}
+	return tags
+}
+
+//jinjaFields the variables used by the template : its names, except the attributes, filters, tests, functions,
+//keyword arguments and the variables defined by set, with, for and macro statements
+func jinjaFields(toks []*tokens.Token) []string {
+	var names []string
+	bound := make(map[string]bool)
+	for _, tag := range jinjaTags(toks) {
+		stmt := ""
+		binding := false // in a macro signature, or before the in of a for statement or the = of a set one
+		for i, tok := range tag {
+			if i == 1 && tag[0].Type == tokens.BlockBegin && tok.Type == tokens.Name {
+				stmt = tok.Val
+				binding = stmt == "for" || stmt == "set" || stmt == "macro"
+				continue
+			}
+			if tok.Type == tokens.In || tok.Type == tokens.Assign && stmt == "set" {
+				binding = false
+			}
+			if i == 0 || tok.Type != tokens.Name || jinjaKeywords[tok.Val] || jinjaDeclarations[stmt] {
+				continue
+			}
+			if binding || i+1 < len(tag) && tag[i+1].Type == tokens.Assign {
+				bound[tok.Val] = true
+				continue
+			}
+			if i+1 < len(tag) && tag[i+1].Type == tokens.Lparen {
+				continue
+			}
+			switch prev := tag[i-1].Type; {
+			case prev == tokens.Dot || prev == tokens.Pipe || prev == tokens.Is:
+				continue
+			case prev == tokens.Not && tag[i-2].Type == tokens.Is:
+				continue
+			}
+			names = append(names, tok.Val)
+		}
+	}
+	var fields []string
+	for _, name := range names {
+		if !bound[name] {
+			fields = append(fields, name)
+		}
+	}
+	RemoveDuplicates(&fields)
+	return fields
+}
+
+//escapeJinja make every expression print its value through escape_value, unless it already ends with an escape filter :
+//the value, and the alternative of a conditional expression, are put in parentheses followed by the filter
+func escapeJinja(toks []*tokens.Token) []jinjaInsert {
+	var inserts []jinjaInsert
+	var value []*tokens.Token
+	inExpr, printed, depth := false, true, 0 // printed : the value or the alternative, not the condition
+	flush := func(end *tokens.Token) {
+		if printed && len(value) > 0 && jinjaNeedsEscape(value) {
+			inserts = append(inserts, jinjaInsert{value[0].Pos, "("}, jinjaInsert{end.Pos, ") | escape_value "})
+		}
+		value = nil
+	}
+	for _, tok := range toks {
+		switch {
+		case tok.Type == tokens.VariableBegin:
+			inExpr, printed, depth = true, true, 0
+		case !inExpr || tok.Type == tokens.Whitespace:
+		case tok.Type == tokens.VariableEnd:
+			flush(tok)
+			inExpr = false
+		case depth == 0 && tok.Type == tokens.Name && (tok.Val == "if" || tok.Val == "else"):
+			flush(tok)
+			printed = tok.Val == "else"
+		default:
+			switch tok.Type {
+			case tokens.Lparen, tokens.Lbracket, tokens.Lbrace:
+				depth++
+			case tokens.Rparen, tokens.Rbracket, tokens.Rbrace:
+				depth--
+			}
+			value = append(value, tok)
+		}
+	}
+	return inserts
+}
+
+//jinjaNeedsEscape check if the expression does not end with an escape filter, outside of brackets
+func jinjaNeedsEscape(expr []*tokens.Token) bool {
+	depth, filter := 0, ""
+	named := false // the filter name was just read, its arguments may follow
+	for _, tok := range expr {
+		switch tok.Type {
+		case tokens.Whitespace:
+			continue
+		case tokens.Lparen, tokens.Lbracket, tokens.Lbrace:
+			if depth == 0 && !(named && tok.Type == tokens.Lparen) {
+				filter = ""
+			}
+			named = false
+			depth++
+			continue
+		case tokens.Rparen, tokens.Rbracket, tokens.Rbrace:
+			depth--
+			continue
+		}
+		switch {
+		case depth > 0:
+		case tok.Type == tokens.Pipe:
+			filter, named = "|", false
+		case tok.Type == tokens.Name && filter == "|":
+			filter, named = tok.Val, true
+		default:
+			filter, named = "", false
+		}
+	}
+	return !isEscapeFunc(filter)
+}
+
+//jinjaFilter the filter calling the template function fn, with the filtered value as first argument,
+//or as the last one with last
+func jinjaFilter(name string, fn interface{}, last bool) exec.FilterFunction {
+	return func(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+		if in.IsError() {
+			return in
+		}
+		if last {
+			return callJinja(name, fn, append(params.Args[:len(params.Args):len(params.Args)], in), params.KwArgs)
+		}
+		return callJinja(name, fn, append([]*exec.Value{in}, params.Args...), params.KwArgs)
+	}
+}
+
+//jinjaFunction the global function calling the template function fn
+func jinjaFunction(name string, fn interface{}) func(*exec.VarArgs) *exec.Value {
+	return func(params *exec.VarArgs) *exec.Value {
+		return callJinja(name, fn, params.Args, params.KwArgs)
+	}
+}
+
+func callJinja(name string, fn interface{}, args []*exec.Value, kwargs map[string]*exec.Value) *exec.Value {
+	if len(kwargs) > 0 {
+		return exec.AsValue(fmt.Errorf("%s: unexpected keyword arguments", name))
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		if arg.IsError() {
+			return arg
+		}
+		if !arg.IsNil() {
+			values[i] = arg.Interface()
+		}
+	}
+	result, err := callFunc(name, fn, values)
+	if err != nil {
+		return exec.AsValue(err)
+	}
+	return exec.AsValue(result)
+}
+
+//jinjaIndent the Jinja2 indent(width=4, first=false) filter, the first line being indented with first
+func jinjaIndent(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+	p := params.Expect(0, []*exec.KwArg{{Name: "width", Default: 4}, {Name: "first", Default: false}})
+	if p.IsError() {
+		return exec.AsValue(fmt.Errorf("indent: %s", p.Error()))
+	}
+	width := p.GetKwarg("width", 4).Integer()
+	if width < 0 {
+		return exec.AsValue(fmt.Errorf("indent: negative width %d", width))
+	}
+	indented := indent(width, in.String())
+	if !p.GetKwarg("first", false).Bool() {
+		indented = indented[width:]
+	}
+	return exec.AsValue(indented)
+}
+
+//callFunc call the template function fn with args converted to its parameters types
+func callFunc(name string, fn interface{}, args []interface{}) (result interface{}, err error) {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	if ft.IsVariadic() && len(args) < ft.NumIn()-1 || !ft.IsVariadic() && len(args) != ft.NumIn() {
+		return nil, fmt.Errorf("%s: wrong number of arguments, got %d", name, len(args))
+	}
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		pt := ft.In(ft.NumIn() - 1)
+		if i < ft.NumIn()-1 || !ft.IsVariadic() {
+			pt = ft.In(i)
+		} else {
+			pt = pt.Elem()
+		}
+		if in[i], err = jinjaArgument(arg, pt); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	defer func() { // like text/template, a panicking function fails the rendering
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: %v", name, r)
+		}
+	}()
+	out := fv.Call(in)
+	if len(out) == 2 && !out[1].IsNil() {
+		return nil, fmt.Errorf("%s: %s", name, out[1].Interface())
+	}
+	return out[0].Interface(), nil
+}
+
+//jinjaArgument convert arg to a value of type t, undefined values being zero
+func jinjaArgument(arg interface{}, t reflect.Type) (reflect.Value, error) {
+	if arg == nil {
+		return reflect.Zero(t), nil
+	}
+	v := reflect.ValueOf(arg)
+	switch {
+	case v.Type().AssignableTo(t):
+		return v, nil
+	case t.Kind() == reflect.String:
+		return reflect.ValueOf(printedValue(arg)).Convert(t), nil
+	case v.Type().ConvertibleTo(t) && isNumberKind(v.Kind()) && isNumberKind(t.Kind()):
+		return v.Convert(t), nil
+	}
+	return reflect.Value{}, fmt.Errorf("cannot use %s as %s", printedValue(arg), t)
+}
+
+func isNumberKind(k reflect.Kind) bool {
+	return reflect.Int <= k && k <= reflect.Float64
+}
+
+//prepareJinja parse the source template with the jinja engine and lookup the values it uses
+func prepareJinja() (renderer, map[string]interface{}, []string, error) {
+	content, err := readSourceTemplate()
+	if err != nil {
+		return nil, nil, nil, &exitError{2, fmt.Errorf("Cannot initialize template du to error : %s", err)}
+	}
+	t, err := parseJinja(sourceName(*sourceTplFile), string(content), templateFuncs(template.New("jinja"), envvalue, globalenvvalue))
+	if err != nil {
+		return nil, nil, nil, &exitError{2, fmt.Errorf("Cannot initialize template du to error : %s", err)}
+	}
+	if err := ensureRemoteValues(); err != nil {
+		return nil, nil, nil, &exitError{3, fmt.Errorf("remote values: %s", err)}
+	}
+	lookup, expandErr := expandingLookup(lookupValue)
+	env, missing := retrieveFieldValues(t.fields, *envPrefix, lookup)
+	if err := expandErr(); err != nil {
+		return nil, nil, nil, &exitError{3, err}
+	}
+	missingVars := make(map[string]bool)
+	for _, name := range missing {
+		missingVars[name] = true
+	}
+	for _, field := range t.fields {
+		t.missing[field] = missingVars[formatPrefixedVar(*envPrefix, field)]
+	}
+	return t, env, missing, nil
+}
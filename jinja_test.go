@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func assertJinja(t *testing.T, tpl string, values map[string]interface{}, expected string) {
+	parsed, err := parseJinja("test.j2", tpl, templateFuncs(template.New("jinja"), envvalue, globalenvvalue))
+	if err != nil {
+		t.Errorf("Jinja template [%s] should be parsed, got %v", tpl, err)
+		return
+	}
+	var buf strings.Builder
+	if err := parsed.Execute(&buf, values); err != nil || buf.String() != expected {
+		t.Errorf("Jinja template [%s] should be rendered into [%s], got [%s] %v", tpl, expected, buf.String(), err)
+	}
+}
+
+func TestJinjaExpressions(t *testing.T) {
+	values := map[string]interface{}{"fqdn": "www.example.org", "servers": []string{"a", "b", "c"}, "enabled": true, "workers": "8"}
+	assertJinja(t, "server_name {{ fqdn }};", values, "server_name www.example.org;")
+	assertJinja(t, "{{ fqdn | upper }} {{ fqdn | replace('www.', '') | slugify }} {{ 'a,b' | comma_split | join('-') }}", values, "WWW.EXAMPLE.ORG example-org a-b")
+	assertJinja(t, "{{ servers[1] }} {{ servers | last }} {{ servers | length }} {{ 'b' in servers }}", values, "b c 3 True")
+	assertJinja(t, "{{ (workers | int) * 2 + 1 }} {{ 7 / 2 }} {{ 7 % 4 }} {{ 'a' ~ 1 }}", values, "17 3.5 3 a1")
+	assertJinja(t, "{{ 'on' if enabled and not missing else 'off' }} {{ missing | default('d') }} {{ missing is defined }}", values, "on d False")
+	assertJinja(t, "{{ concat(fqdn, ':', 80) }} {{ sprintf('%s-%d', 'w', 2) }} {{ fqdn | envname }}", values, "www.example.org:80 w-2 WWW_EXAMPLE_ORG")
+	assertJinja(t, "{{ \"a\\nb\" | indent(2) }}|{{ \"a\\nb\" | indent(2, true) }}|{{ 'a' | nindent(2) }}", values, "a\n  b|  a\n  b|\n  a")
+}
+
+func TestJinjaStatements(t *testing.T) {
+	values := map[string]interface{}{"servers": []string{"a", "b"}, "empty": []string{}, "port": "80"}
+	assertJinja(t, "{% for s in servers %}{{ loop.index }}:{{ s }}{% if not loop.last %},{% endif %}{% endfor %}", values, "1:a,2:b")
+	assertJinja(t, "{% for s in empty %}{{ s }}{% else %}none{% endfor %}", values, "none")
+	assertJinja(t, "{% if port == '443' %}tls{% elif port == '80' %}plain{% else %}other{% endif %}", values, "plain")
+	assertJinja(t, "{% set url = 'http://h:' ~ port %}{{ url }}", values, "http://h:80")
+	assertJinja(t, "{% for k, v in m %}{{ k }}={{ v }};{% endfor %}", map[string]interface{}{"m": map[string]int{"b": 2, "a": 1}}, "a=1;b=2;")
+	assertJinja(t, "<ul>\n{% for s in servers %}\n  <li>{{ s }}</li>\n{% endfor %}\n</ul>", values, "<ul>\n  <li>a</li>\n  <li>b</li>\n</ul>")
+	assertJinja(t, "a   {#- comment -#}   b {{- ' c ' -}} d", values, "ab c d")
+	assertJinja(t, "{% if port -%}\n  a\n{%- endif %}\n{% raw %}\n{{ b }}{% endraw %}", values, "a\n{{ b }}")
+}
+
+func TestJinjaFields(t *testing.T) {
+	tpl := `{% set url = 'http://' ~ host %}{% for k, v in servers | dictsort if v is not none %}{{ k | upper }} {{ loop.index }}{% endfor %}
+{% macro m(x) %}{{ x }}{% endmacro %}{{ m(root) }} {{ concat(url, tls.port) }} {{ cert is defined }} {{ sprintf(format='%s') }}`
+	parsed, err := parseJinja("test.j2", tpl, templateFuncs(template.New("jinja"), envvalue, globalenvvalue))
+	if err != nil || !reflect.DeepEqual(parsed.fields, []string{"host", "servers", "root", "tls", "cert"}) {
+		t.Errorf("The variables used by the template should be listed, got %v %v", parsed, err)
+	}
+}
+
+func TestJinjaStrictEscape(t *testing.T) {
+	*outputFormat, *strictEscape = "shell", true
+	defer func() { *outputFormat, *strictEscape = "", false }()
+	values := map[string]interface{}{"a": "it's", "b": "c"}
+	assertJinja(t, "{{ a }} {{ a | raw }} {{ a | shell_quote }} {{ a | replace('i', 'I') }} {{ (a | raw) ~ b }}", values, `'it'\''s' it's 'it'\''s' 'It'\''s' 'it'\''sc'`)
+	assertJinja(t, "{{ a if b else b | raw }} {{ b | raw if not b else a }} {% for x in [a] %}{{ x }}{% endfor %}", values, `'it'\''s' 'it'\''s' 'it'\''s'`)
+}
+
+func TestJinjaErrors(t *testing.T) {
+	funcs := templateFuncs(template.New("jinja"), envvalue, globalenvvalue)
+	for tpl, expected := range map[string]string{
+		"{{ a b }}":            "'}}' expected here",
+		"{% if a %}\n\nno end": "expected tag elif or else or endif",
+		"{% include 'a.j2' %}": "includes are not supported by the jinja engine",
+	} {
+		if _, err := parseJinja("test.j2", tpl, funcs); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Jinja template [%s] should fail with [%s], got %v", tpl, expected, err)
+		}
+	}
+	for tpl, expected := range map[string]string{
+		"{{ 'a' | indent(-1) }}":                           "indent: negative width -1",
+		"{{ 'a' | nindent(-1) }}":                          "nindent: strings: negative Repeat count",
+		"{{ 'a' | regexp_replace('(', 'b') }}":             "regexp_replace: regexp: Compile",
+		"{{ 'a' | nope }}":                                 `Filter "nope" not found`,
+		"\n{{ 'a' | slugify(1) }}":                         "line 2: filtered_expression(a)",
+		"{% if true %}\n{{ 'a' | slugify(1) }}{% endif %}": "line 2: filtered_expression(a)",
+	} {
+		parsed, err := parseJinja("test.j2", tpl, funcs)
+		if err != nil {
+			t.Errorf("Jinja template [%s] should be parsed, got %v", tpl, err)
+			continue
+		}
+		if err := parsed.Execute(ioutil.Discard, map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Jinja template [%s] should fail with [%s], got %v", tpl, expected, err)
+		}
+	}
+}
+
+func TestRenderTargetWithJinjaEngine(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	*sourceTplFile = filepath.Join(dir, "vhost.conf.j2")
+	*targetFile = filepath.Join(dir, "target.conf")
+	*engine = "jinja"
+	defer func() { *targetFile, *engine = "", "go" }()
+	ioutil.WriteFile(*sourceTplFile, []byte(`{% for alias in serverAliases %}{{ alias }} {% endfor %}{{ root | default("/srv") }} {{ tls_cert is defined }} [{{ tls_cert }}]`), 0644)
+	os.Setenv("APPCONF_SERVER_ALIASES", "a.org,b.org")
+	defer os.Unsetenv("APPCONF_SERVER_ALIASES")
+
+	result, err := renderTarget()
+	content, _ := ioutil.ReadFile(*targetFile)
+	expected := "a.org b.org /srv False []"
+	if err != nil || string(content) != expected {
+		t.Errorf("Target should be rendered with the jinja engine, got [%s] %v", content, err)
+	}
+	if !reflect.DeepEqual(result.missing, []string{"APPCONF_ROOT", "APPCONF_TLS_CERT"}) {
+		t.Errorf("Missing variables should be reported, got %v", result.missing)
+	}
+}
@@ -4,60 +4,259 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"text/template"
 	"text/template/parse"
+	"time"
 	"unicode"
 	"reflect"
-	"path/filepath"
 )
 
 const (
-	missingVarStr = "####### DKCONF : MISSING ENV VAR FOR GO TPL VALUE: %s, SHOULD BE %s #######"
+	missingVarStr   = "####### DKCONF : MISSING ENV VAR FOR GO TPL VALUE: %s, SHOULD BE %s #######"
+	maxIncludeDepth = 32
 )
 
 var (
-	sourceTplFile = flag.String("s", "", "absolute path to the source template file")
+	sourceTplFile = flag.String("s", "", "absolute path to the source template file, or its http(s) url")
 	targetFile    = flag.String("t", "", "absolute path to the target file generated")
 	envPrefix     = flag.String("p", "APPCONF", "env var prefix")
+	changedFile   = flag.String("changed-file", "", "path of a marker file written when the target changed and removed otherwise")
+	changedExit   = flag.Int("changed-exit", 0, "exit code to use when the target changed (0 to disable)")
+	checkOnly     = flag.Bool("check", false, "do not write the target, exit with code 4 if it differs from the rendered template")
+	diffColor     = flag.Bool("color", false, "colorize the output of the diff command")
+	validateCmd   = flag.String("validate", "", "command validating the rendered file before it replaces the target, {{target}} is replaced by its quoted path")
+	reloadCmd     = flag.String("reload", "", "command to run after the target changed")
+	backupCount   = flag.Int("backup", 0, "number of previous versions of the target to keep as backups (0 to disable)")
+	pollInterval  = flag.Duration("poll", time.Second, "interval between two checks of the watched files in watch mode")
+	debounceDelay = flag.Duration("debounce", 500*time.Millisecond, "delay without change before rendering in watch mode")
+	reloadSignal  = flag.String("reload-signal", "HUP", "signal sent to the supervised command after the target changed")
+	fetchInterval = flag.Duration("interval", 0, "interval between two fetches of the remote values and source template in watch mode (0 to fetch them once)")
+	listenAddr    = flag.String("listen", "", "address of the /healthz, /livez, /readyz and /metrics endpoints in watch and supervisor modes, or of the serve command (default :8080)")
+	webhookURL    = flag.String("webhook", "", "url to which a JSON event is posted after each rendering")
+	eventSocket   = flag.String("event-socket", "", "path of a unix socket to which a JSON event is written after each rendering")
+	templatesDir  = flag.String("templates", "", "directory of the named templates rendered by the serve command")
+	sourceSHA256  = flag.String("s-sha256", "", "pinned sha256 checksum of the source template")
+	cacheDir      = flag.String("cache-dir", "", "directory where remote source templates are cached (default user cache dir)")
+	fetchTimeout  = flag.Duration("fetch-timeout", 10*time.Second, "timeout of the fetch of a remote source template")
+	checksumsFile = flag.String("checksums", "", "file of pinned sha256 checksums of the templates, in the sha256sum format")
+	verifyKey     = flag.String("verify-key", "", "minisign public key verifying the signature <template>.minisig of each template")
+	signKey       = flag.String("key", "", "minisign secret key used by the sign command")
+	generateKey   = flag.Bool("generate", false, "generate the secret key given with -key and its .pub public key with the sign command")
+	forceKeys     = flag.Bool("force", false, "overwrite existing keys with sign -generate")
+	outputFormat  = flag.String("format", "", "format of the target, escaping the values with escape_value or -strict-escape: nginx, yaml, json, ini, toml, xml, shell or properties")
+	strictEscape  = flag.Bool("strict-escape", false, "escape every printed value according to -format")
+	engine        = flag.String("engine", "go", "template engine of the source template: go, envsubst or jinja")
+	allowedVars   stringList
+	expandVars    = flag.Bool("expand", false, "expand the ${VAR}, ${VAR:-default} and ${VAR:?error} references in the values")
+	tplValues     = flag.Bool("render-values", false, "render the values containing the left delimiter as templates, against the other values")
+	watchPaths    stringList
+	includePaths  stringList
+	htmlOutput    optionalBool
+	valuesURLs    stringList
+	templateDelims = delimiters{"{{", "}}"}
 	envList map[string]interface{} = nil
 	globalEnvList map[string]interface{} = nil
 )
 
-//ListTemplFields List field in templates
+func init() {
+	flag.Var(&includePaths, "I", "directory of *.tmpl partials usable with {{ template \"name.tmpl\" . }} (repeatable)")
+	flag.Var(&watchPaths, "watch", "additional file or directory to watch in watch mode (repeatable)")
+	flag.Var(&templateDelims, "delims", "left and right template delimiters, separated by a space, such as '[[ ]]'")
+	flag.Var(&allowedVars, "allow", "name of an env var substituted by the envsubst engine, instead of those with the prefix (repeatable)")
+	flag.Var(&htmlOutput, "html", "escape the values according to their context with html/template, the default for .html and .htm targets unless -html=false")
+	flag.Var(&valuesURLs, "values-url", "url of a JSON object of remote values, used when the env var is not set (repeatable)")
+}
+
+//stringList a flag which can be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+//optionalBool a boolean flag remembering if it was given, overriding its default
+type optionalBool struct {
+	value bool
+	set   bool
+}
+
+func (b *optionalBool) String() string {
+	return strconv.FormatBool(b.value)
+}
+
+func (b *optionalBool) Set(v string) error {
+	value, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	b.value, b.set = value, true
+	return nil
+}
+
+func (b *optionalBool) IsBoolFlag() bool {
+	return true
+}
+
+//delimiters the left and right delimiters of the templates
+type delimiters [2]string
+
+func (d *delimiters) String() string {
+	return strings.Join(d[:], " ")
+}
+
+func (d *delimiters) Set(v string) error {
+	fields := strings.Fields(v)
+	if len(fields) != 2 {
+		return fmt.Errorf("left and right delimiters separated by a space expected, got %q", v)
+	}
+	d[0], d[1] = fields[0], fields[1]
+	return nil
+}
+
+//ListTemplFields List field in templates, and in the templates they include
 func ListTemplFields(t *template.Template) []string {
-	return listNodeFields(t.Tree.Root, nil)
+	return listNodeFields(t, t.Tree.Root, nil, map[string]bool{t.Name(): true}, true)
 }
 
-//listNodeFields list fields in templates nodes
-func listNodeFields(node parse.Node, res []string) []string {
+//listNodeFields list fields in templates nodes, following the template actions to the associated templates of t.
+//Dot holds the root data if root, not in range and with bodies where only $ variables and the templates given $ are listed
+func listNodeFields(t *template.Template, node parse.Node, res []string, visited map[string]bool, root bool) []string {
 	if node.Type() == parse.NodeRange { // range list
 		rangeNode := node.(*parse.RangeNode)
-		listName := rangeNode.Pipe.Cmds[0].Args[0].String()
-		formatedName := fmt.Sprintf("{{%s}}", listName)
-		res = append(res, formatedName)
+		if root {
+			listName := rangeNode.Pipe.Cmds[0].Args[0].String()
+			formatedName := fmt.Sprintf("{{%s}}", listName)
+			res = append(res, formatedName)
+		} else {
+			res = listPipeFields(t, rangeNode.Pipe, res, visited, false)
+		}
+		// dot is an item of the list in the body, and unchanged in the else branch
+		res = listNodeFields(t, rangeNode.List, res, visited, false)
+		if rangeNode.ElseList != nil {
+			res = listNodeFields(t, rangeNode.ElseList, res, visited, root)
+		}
+	}
+
+	if node.Type() == parse.NodeWith {
+		withNode := node.(*parse.WithNode)
+		res = listPipeFields(t, withNode.Pipe, res, visited, root)
+		// dot is the value of the pipeline in the body, and unchanged in the else branch
+		res = listNodeFields(t, withNode.List, res, visited, false)
+		if withNode.ElseList != nil {
+			res = listNodeFields(t, withNode.ElseList, res, visited, root)
+		}
 	}
 
 	if node.Type() == parse.NodeIf {
 		ifNode := node.(*parse.IfNode)
-		ifVarName := ifNode.Pipe.Cmds[0].Args[0].String()
-		formatedName := fmt.Sprintf("{{%s}}", ifVarName)
-		res = append(res, formatedName)
+		if root {
+			ifVarName := ifNode.Pipe.Cmds[0].Args[0].String()
+			formatedName := fmt.Sprintf("{{%s}}", ifVarName)
+			res = append(res, formatedName)
+		} else {
+			res = listPipeFields(t, ifNode.Pipe, res, visited, false)
+		}
+		// dot is unchanged in if branches
+		res = listNodeFields(t, ifNode.List, res, visited, root)
+		if ifNode.ElseList != nil {
+			res = listNodeFields(t, ifNode.ElseList, res, visited, root)
+		}
+	}
 
+	if node.Type() == parse.NodeTemplate { // included template
+		templateNode := node.(*parse.TemplateNode)
+		if root || isRootPipe(templateNode.Pipe) {
+			res = listIncludedFields(t, templateNode.Name, res, visited)
+		}
 	}
 
-	if node.Type() == parse.NodeAction { // variable to interpret
-		res = append(res, node.String())
+	if node.Type() == parse.NodeAction { // variables to interpret
+		res = listPipeFields(t, node.(*parse.ActionNode).Pipe, res, visited, root)
 	}
 
 	if ln, ok := node.(*parse.ListNode); ok {
 		for _, n := range ln.Nodes {
-			res = listNodeFields(n, res)
+			res = listNodeFields(t, n, res, visited, root)
+		}
+	}
+	return res
+}
+
+//listPipeFields list fields used by the commands of a pipeline, and in the templates it includes,
+//string arguments are not parsed so that a dot in "name.tmpl" is not taken for a field
+func listPipeFields(t *template.Template, pipe *parse.PipeNode, res []string, visited map[string]bool, root bool) []string {
+	if pipe == nil {
+		return res
+	}
+	for _, cmd := range pipe.Cmds {
+		for i, arg := range cmd.Args {
+			if str, ok := arg.(*parse.StringNode); ok {
+				if ident, ok := cmd.Args[0].(*parse.IdentifierNode); ok && i == 1 && ident.Ident == "include" &&
+					(root || len(cmd.Args) > 2 && isRootData(cmd.Args[2])) {
+					res = listIncludedFields(t, str.Text, res, visited)
+				}
+				continue
+			}
+			res = listArgFields(t, arg, res, visited, root)
+		}
+	}
+	return res
+}
+
+//listArgFields list the field used by a command argument : .Field if dot holds the root data, $.Field of the root data,
+//or those of a chain such as (.Field).Key or of a parenthesized pipeline
+func listArgFields(t *template.Template, arg parse.Node, res []string, visited map[string]bool, root bool) []string {
+	switch arg := arg.(type) {
+	case *parse.FieldNode:
+		if root {
+			res = append(res, fmt.Sprintf("{{%s}}", arg.String()))
 		}
+	case *parse.VariableNode: // other variables do not hold the root data
+		if len(arg.Ident) > 1 && arg.Ident[0] == "$" {
+			res = append(res, fmt.Sprintf("{{%s}}", arg.String()))
+		}
+	case *parse.ChainNode:
+		res = listArgFields(t, arg.Node, res, visited, root)
+	case *parse.PipeNode:
+		res = listPipeFields(t, arg, res, visited, root)
+	}
+	return res
+}
+
+//isRootData check if a command argument is $, the root data
+func isRootData(arg parse.Node) bool {
+	variable, ok := arg.(*parse.VariableNode)
+	return ok && len(variable.Ident) == 1 && variable.Ident[0] == "$"
+}
+
+//isRootPipe check if a pipeline is only $, the root data
+func isRootPipe(pipe *parse.PipeNode) bool {
+	return pipe != nil && len(pipe.Cmds) == 1 && len(pipe.Cmds[0].Args) == 1 && isRootData(pipe.Cmds[0].Args[0])
+}
+
+//listIncludedFields list fields in the associated template name of t, once
+func listIncludedFields(t *template.Template, name string, res []string, visited map[string]bool) []string {
+	if included := t.Lookup(name); included != nil && included.Tree != nil && !visited[name] {
+		visited[name] = true
+		res = listNodeFields(t, included.Tree.Root, res, visited, true)
 	}
 	return res
 }
@@ -78,19 +277,154 @@ func RemoveDuplicates(xs *[]string) {
 
 //initializeTemplate allow to initializeTemplate by creating template invocation and by listing field
 func initializeTemplate() (*template.Template, error) {
-	var t *template.Template = template.New(filepath.Base(*sourceTplFile))
-	var err error
-	prepareTemplate(t)
-	t, err = t.ParseFiles(*sourceTplFile)
+	content, err := readSourceTemplate()
 	if err != nil {
 		log.Print(err)
 		return nil, err
 	}
+	// the extended templates are parsed first, so that the define actions of the extending ones override their blocks
+	contents := []string{string(content)}
+	seen := map[string]bool{*sourceTplFile: true}
+	for base := extendedSource(*sourceTplFile, content); base != ""; base = extendedSource(base, content) {
+		if seen[base] {
+			err = fmt.Errorf("%s: circular extends", base)
+			log.Print(err)
+			return nil, err
+		}
+		seen[base] = true
+		if content, err = readSource(base); err != nil {
+			log.Print(err)
+			return nil, err
+		}
+		contents = append(contents, string(content))
+	}
+	var t *template.Template = template.New(sourceName(*sourceTplFile))
+	prepareTemplate(t)
+	for i := len(contents) - 1; i >= 0; i-- {
+		if _, err = t.Parse(contents[i]); err != nil {
+			log.Print(err)
+			return nil, err
+		}
+	}
+	if err = parseIncludes(t); err != nil {
+		log.Print(err)
+		return nil, err
+	}
 	return t, err
 }
 
+//parseIncludes parse the *.tmpl files of the include paths as templates associated to t, named after their file name.
+//A name found in several include paths is taken from the first one
+func parseIncludes(t *template.Template) error {
+	seen := map[string]bool{t.Name(): true}
+	for _, dir := range includePaths {
+		files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			name := filepath.Base(file)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			content, err := readSource(file)
+			if err != nil {
+				return err
+			}
+			if _, err := t.New(name).Parse(string(content)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//readSourceTemplate read the source template, checked against -s-sha256 or its pinned checksum
+func readSourceTemplate() ([]byte, error) {
+	var err error
+	pinned := *sourceSHA256
+	if pinned == "" {
+		pinned, err = pinnedChecksum(*sourceTplFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	source, err := resolveSource(*sourceTplFile, pinned)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(source)
+}
+
+//readSource read the template src, fetched and checked by resolveSource against its pinned checksum
+func readSource(src string) ([]byte, error) {
+	pinned, err := pinnedChecksum(src)
+	if err != nil {
+		return nil, err
+	}
+	source, err := resolveSource(src, pinned)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(source)
+}
+
+//extendedSource the template extended by the content of the template src with an extends comment,
+//relative to src, or "" when it extends none
+func extendedSource(src string, content []byte) string {
+	extendsDirective := regexp.MustCompile(`^\s*` + regexp.QuoteMeta(templateDelims[0]) + `-?\s*/\*\s*extends\s+"([^"]+)"\s*\*/\s*-?` + regexp.QuoteMeta(templateDelims[1]))
+	match := extendsDirective.FindSubmatch(content)
+	if match == nil {
+		return ""
+	}
+	base := string(match[1])
+	if isRemoteSource(src) {
+		if u, err := url.Parse(src); err == nil {
+			if ref, err := u.Parse(base); err == nil {
+				return ref.String()
+			}
+		}
+		return base
+	}
+	if filepath.IsAbs(base) || isRemoteSource(base) {
+		return base
+	}
+	return filepath.Join(filepath.Dir(src), base)
+}
+
+//extendedSources list the local templates extended, directly or not, by the template src
+func extendedSources(src string) []string {
+	var res []string
+	seen := map[string]bool{src: true}
+	for {
+		content, err := ioutil.ReadFile(src)
+		if err != nil {
+			return res
+		}
+		if src = extendedSource(src, content); src == "" || seen[src] || isRemoteSource(src) {
+			return res
+		}
+		seen[src] = true
+		res = append(res, src)
+	}
+}
+
 func prepareTemplate(t * template.Template) (* template.Template) {
-	t.Funcs(template.FuncMap{
+	return prepareTemplateWith(t, envvalue, globalenvvalue)
+}
+
+//prepareTemplateWith add the dkconf functions to the template, env and global_env looking up values with the given functions
+func prepareTemplateWith(t *template.Template, env func(string) interface{}, globalEnv func(string) interface{}) *template.Template {
+	t.Delims(templateDelims[0], templateDelims[1])
+	t.Funcs(templateFuncs(t, env, globalEnv))
+	return t
+}
+
+//templateFuncs the dkconf functions, include and tpl using the templates associated to t
+func templateFuncs(t *template.Template, env func(string) interface{}, globalEnv func(string) interface{}) template.FuncMap {
+	includeDepth := 0 // nesting of include and tpl calls
+	return template.FuncMap{
 		"is_iterable": func(v interface{}) bool {
 			vr := reflect.ValueOf(v)
 			switch vr.Kind() {
@@ -111,8 +445,8 @@ func prepareTemplate(t * template.Template) (* template.Template) {
 		"underscore": underscore,
 		"snakize": snakize,
 		"envname": envname,
-		"env": envvalue,
-		"global_env": globalenvvalue,
+		"env": env,
+		"global_env": globalEnv,
 		"split": func (optional_params ...string) []string {
 			var v, sep string
 			if (len(optional_params) >= 2) {
@@ -146,7 +480,7 @@ func prepareTemplate(t * template.Template) (* template.Template) {
 		"env_list": func (v string) []string {
 			var sep string = ","
 
-			return strings.Split(envvalue(v).(string), sep)
+			return strings.Split(env(v).(string), sep)
 		},
 		"dump": func (v interface{}) string {
 			return fmt.Sprintf("%+v", v)
@@ -242,8 +576,57 @@ func prepareTemplate(t * template.Template) (* template.Template) {
 				return 0
 			}
 		},
-	})
-	return t
+		"include": func(name string, data interface{}) (string, error) {
+			included := t.Lookup(name)
+			if included == nil {
+				return "", fmt.Errorf("include: no template %q", name)
+			}
+			if includeDepth >= maxIncludeDepth {
+				return "", fmt.Errorf("include %s: maximum include depth of %d exceeded", name, maxIncludeDepth)
+			}
+			includeDepth++
+			defer func() { includeDepth-- }()
+			var buf strings.Builder
+			err := included.Execute(&buf, data)
+			return buf.String(), err
+		},
+		"tpl": func(v string, data interface{}) (string, error) {
+			if includeDepth >= maxIncludeDepth {
+				return "", fmt.Errorf("tpl: maximum include depth of %d exceeded", maxIncludeDepth)
+			}
+			includeDepth++
+			defer func() { includeDepth-- }()
+			value, err := t.New("tpl").Parse(v)
+			if err != nil {
+				return "", err
+			}
+			var buf strings.Builder
+			err = value.Execute(&buf, data)
+			return buf.String(), err
+		},
+		"raw": func(v interface{}) interface{} {
+			return v
+		},
+		"escape_value": escapeValue,
+		"nginx_quote": nginxQuote,
+		"yaml_quote": quoteString,
+		"json_string": quoteString,
+		"toml_string": quoteString,
+		"ini_value": iniValue,
+		"xml_escape": xmlEscape,
+		"shell_quote": shellQuote,
+		"properties_value": propertiesValue,
+		"indent": indent,
+		"nindent": func(spaces int, v string) string {
+			return "\n" + indent(spaces, v)
+		},
+	}
+}
+
+//indent prefix each line of v with spaces
+func indent(spaces int, v string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.Replace(v, "\n", "\n"+pad, -1)
 }
 
 func SpaceMap(str string) string {
@@ -255,7 +638,8 @@ func SpaceMap(str string) string {
 	}, str)
 }
 
-//extractFieldName list fields name in template
+//extractFieldName list fields name in template, fields are listed from the parse tree with the default delimiters
+//whatever those of the template
 func extractFieldName(s string) string {
 	re := regexp.MustCompile(`\{\{\s*[^\.]*\.([^\."]+).*\s*\}\}`)
 	match := re.FindStringSubmatch(s)
@@ -267,8 +651,13 @@ func extractFieldName(s string) string {
 
 //formatEnvVar format an env
 func formatEnvVar(value string) string {
+	return formatPrefixedVar(*envPrefix, value)
+}
+
+//formatPrefixedVar format an env with the given prefix
+func formatPrefixedVar(prefix string, value string) string {
 	bashStyleField := replaceUpperWithUnderscore(value)
-	return fmt.Sprintf("%s_%s", *envPrefix, strings.ToUpper(bashStyleField))
+	return fmt.Sprintf("%s_%s", prefix, strings.ToUpper(bashStyleField))
 }
 
 //replaceUpperWithUnderscore lookup at camelcase style words and split at each maj to allow an underscore insertion
@@ -301,28 +690,44 @@ func globalenvs() map[string]interface{} {
 	return globalEnvList
 }
 
+//resetEnvs forget the memoized env lists so they are built again on next use
+func resetEnvs() {
+	envList = nil
+	globalEnvList = nil
+}
+
 func buildEnv () (map[string]interface{}) {
+	return buildEnvFrom(environ(), *envPrefix)
+}
+
+//buildEnvFrom build the env list of the key=value pairs of environ having the given prefix
+func buildEnvFrom(environ []string, prefix string) map[string]interface{} {
 	env := make(map[string]interface{})
 	var key string
 	var value interface{}
-	for _, e := range os.Environ() {
+	for _, e := range environ {
 		pair := strings.Split(e, "=")
 		key = pair[0]
 		value = pair[1]
-		if (!strings.HasPrefix(key, *envPrefix)) {
+		if (!strings.HasPrefix(key, prefix)) {
 			continue
 		}
-		env[slugify(strings.TrimPrefix(strings.TrimPrefix(key, *envPrefix), `_`))] = formatRawValue(value)
+		env[slugify(strings.TrimPrefix(strings.TrimPrefix(key, prefix), `_`))] = formatRawValue(value)
 	}
 
 	return env
 }
 
 func buildGlobalEnv () (map[string]interface{}) {
+	return buildGlobalEnvFrom(environ())
+}
+
+//buildGlobalEnvFrom build the global env list of the key=value pairs of environ
+func buildGlobalEnvFrom(environ []string) map[string]interface{} {
 	env := make(map[string]interface{})
 	var key string
 	var value interface{}
-	for _, e := range os.Environ() {
+	for _, e := range environ {
 		pair := strings.Split(e, "=")
 		key = pair[0]
 		value = pair[1]
@@ -381,34 +786,110 @@ func envname (v string) (string) {
 
 //retrieveEnv list all field present in template and lookup at env var that match in bash style : A_B_C
 func retrieveEnv(t *template.Template) (map[string]interface{}, []string) {
-	fieldList := ListTemplFields(t)
+	return retrieveValues(t, *envPrefix, lookupValue)
+}
+
+//retrieveValues list all field present in template and lookup the values with the given prefix and lookup function
+func retrieveValues(t *template.Template, prefix string, lookup func(string) (string, bool)) (map[string]interface{}, []string) {
+	var fields []string
+	for _, field := range ListTemplFields(t) {
+		fields = append(fields, extractFieldName(field))
+	}
+	return retrieveFieldValues(fields, prefix, lookup)
+}
+
+//retrieveFieldValues lookup the values of the fields with the given prefix and lookup function
+func retrieveFieldValues(fields []string, prefix string, lookup func(string) (string, bool)) (map[string]interface{}, []string) {
 	var missingList []string
 	env := make(map[string]interface{})
-	RemoveDuplicates(&fieldList)
-	for _, field := range fieldList {
-		realField := extractFieldName(field)
-		formatedVar := formatEnvVar(realField)
-		val, ok := os.LookupEnv(formatedVar)
+	RemoveDuplicates(&fields)
+	for _, realField := range fields {
+		if realField == "" { // action without field, such as a function call
+			continue
+		}
+		formatedVar := formatPrefixedVar(prefix, realField)
+		val, ok := lookup(formatedVar)
 		if ok {
-			if strings.Contains(val, ",") { // list
-				values := strings.Split(val, ",")
-				env[realField] = values
-			} else {
-				if val == "true" || val == "false" { // boolean
-					val, _ := strconv.ParseBool(val)
-					env[realField] = val
-				} else { // others
-					env[realField] = val
-				}
-			}
+			env[realField] = typedValue(val)
 		} else {
 			env[realField] = fmt.Sprintf(missingVarStr, realField, formatedVar)
-			//missingList = append(missingList, formatedVar)
+			missingList = append(missingList, formatedVar)
 		}
 	}
+	RemoveDuplicates(&missingList)
 	return env, missingList
 }
 
+//typedValue convert the string value of an env var into a list when it holds commas, or into a boolean
+func typedValue(val string) interface{} {
+	if strings.Contains(val, ",") { // list
+		return strings.Split(val, ",")
+	}
+	if val == "true" || val == "false" { // boolean
+		b, _ := strconv.ParseBool(val)
+		return b
+	}
+	return val // others
+}
+
+//renderValueTemplates render the values of config whose env var contains template actions, as templates associated to t
+//executed against the other values, before their conversion into lists or booleans. The values they use are looked up
+//like those of the source template and rendered first
+func renderValueTemplates(t *template.Template, config map[string]interface{}, prefix string, lookup func(string) (string, bool)) ([]string, error) {
+	var missingList []string
+	rendering, rendered := map[string]bool{}, map[string]bool{}
+	var render func(field string, path []string) error
+	render = func(field string, path []string) error {
+		if rendering[field] {
+			return fmt.Errorf("variable %s: circular reference %s", formatPrefixedVar(prefix, path[0]), strings.Join(append(path, field), " -> "))
+		}
+		val, ok := lookup(formatPrefixedVar(prefix, field)) // config holds the converted value
+		if rendered[field] || !ok || !strings.Contains(val, templateDelims[0]) {
+			return nil
+		}
+		rendering[field] = true
+		path = append(path, field)
+		value, err := t.New("value " + field).Parse(val)
+		if err != nil {
+			return fmt.Errorf("variable %s: %s", formatPrefixedVar(prefix, field), err)
+		}
+		values, missing := retrieveValues(value, prefix, lookup)
+		missingList = append(missingList, missing...)
+		for _, name := range sortedKeys(values) {
+			if _, ok := config[name]; !ok {
+				config[name] = values[name]
+			}
+			if err := render(name, path); err != nil {
+				return err
+			}
+		}
+		var buf strings.Builder
+		if err := value.Execute(&buf, config); err != nil {
+			return fmt.Errorf("variable %s: %s", formatPrefixedVar(prefix, field), err)
+		}
+		config[field] = typedValue(buf.String())
+		rendering[field], rendered[field] = false, true
+		return nil
+	}
+	for _, field := range sortedKeys(config) {
+		if err := render(field, nil); err != nil {
+			return nil, err
+		}
+	}
+	RemoveDuplicates(&missingList)
+	return missingList, nil
+}
+
+//sortedKeys keys of m in order
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 //checkFileExists check if file exists in filesystem
 func checkFileExists(path string) bool {
 	if _, err := os.Stat(path); err == nil {
@@ -436,53 +917,189 @@ func globalenvvalue(key string) interface{} {
 	return nil
 }
 //parseTemplate parse the template with the given config map built in reading env var
-func parseTemplate(t *template.Template, config map[string]interface{}) error {
+func parseTemplate(t renderer, config map[string]interface{}) error {
+	_, err := processTemplate(t, config)
+	return err
+}
+
+//processTemplate render the template to stdout or to the target file, returns true when the target changed
+func processTemplate(t renderer, config map[string]interface{}) (bool, error) {
 	if *targetFile == "" { // if no target file is defined we output to stdout
 		f := bufio.NewWriter(os.Stdout)
 		defer f.Flush()
 		err := t.Execute(f, config)
 		if err != nil {
 			log.Print("execute: ", err)
-			return err
+			return false, err
 		}
-	} else { // if we have target file we write to it
-		f, err := os.Create(*targetFile)
-		if err != nil {
-			log.Println("create file: ", err)
-			return err
+		return false, nil
+	}
+	// if we have target file we write to it, only when its content differs
+	content, err := renderTemplate(t, config)
+	if err != nil {
+		log.Print("execute: ", err)
+		return false, err
+	}
+	changed, err := writeTarget(*targetFile, content)
+	if err != nil {
+		log.Println("write file: ", err)
+		return false, err
+	}
+	if changed && *reloadCmd != "" {
+		if err := runHook(*reloadCmd, *targetFile); err != nil {
+			log.Println("reload: ", err)
+			return changed, err
 		}
-		err = t.Execute(f, config)
-		if err != nil {
-			log.Print("execute: ", err)
-			return err
+	}
+	return changed, nil
+}
+
+//parseCommandLine parse flags, an optional leading command name is returned
+func parseCommandLine() string {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s: [render|diff|rollback|watch|supervise|serve|sign] [flags] [-- command args...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "render", "diff", "rollback", "watch", "supervise", "serve", "sign":
+			flag.CommandLine.Parse(os.Args[2:])
+			return os.Args[1]
 		}
-		f.Close()
 	}
-	return nil
+	flag.Parse()
+	return "render"
 }
 
 func main() {
-	flag.Parse()
+	command := parseCommandLine()
+
+	if command == "sign" {
+		if *signKey == "" {
+			log.Println("A secret key is required to sign templates")
+			os.Exit(1)
+		}
+		if *generateKey {
+			public := strings.TrimSuffix(*signKey, filepath.Ext(*signKey)) + ".pub"
+			if err := generateKeys(*signKey, public, *forceKeys); err != nil {
+				log.Print("generate: ", err)
+				os.Exit(3)
+			}
+			log.Printf("Generated %s and %s", *signKey, public)
+		}
+		files := flag.Args()
+		if *sourceTplFile != "" {
+			files = append([]string{*sourceTplFile}, files...)
+		}
+		for _, file := range files {
+			if err := signFile(file, *signKey); err != nil {
+				log.Print("sign: ", err)
+				os.Exit(3)
+			}
+			log.Printf("Signed %s", file)
+		}
+		return
+	}
+
+	if command == "serve" {
+		addr := *listenAddr
+		if addr == "" {
+			addr = defaultServeAddr
+		}
+		log.Printf("Serving render requests on %s", addr)
+		log.Fatal(http.ListenAndServe(addr, renderHandler(*templatesDir)))
+	}
 
-	if !checkFileExists(*sourceTplFile) {
-		str := fmt.Sprintf("Source Template File does not exists : %s", *sourceTplFile)
-		log.Println(str)
+	if (command != "render" || *checkOnly) && *targetFile == "" {
+		log.Println("A target file is required for this command")
 		os.Exit(1)
 	}
 
-	t, err := initializeTemplate()
+	if command == "rollback" {
+		backup, err := rollbackTarget(*targetFile)
+		if err != nil {
+			log.Print("rollback: ", err)
+			os.Exit(3)
+		}
+		log.Printf("Restored %s from %s", *targetFile, backup)
+		return
+	}
 
-	if err != nil {
-		str := fmt.Sprintf("Cannot initialize template du to error : %s", err)
-		log.Println(str)
-		os.Exit(2)
+	if command == "watch" || command == "supervise" {
+		if err := checkWatchable(); err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+	}
+
+	if (command == "watch" || command == "supervise") && *listenAddr != "" {
+		if err := startStatusServer(*listenAddr); err != nil {
+			log.Print("listen: ", err)
+			os.Exit(1)
+		}
+	}
+
+	if command == "watch" {
+		stop := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			close(stop)
+		}()
+		watchLoop(stop, nil)
+		return
+	}
+
+	if command == "supervise" {
+		args := flag.Args()
+		if len(args) == 0 {
+			log.Println("A command to supervise is required after --")
+			os.Exit(1)
+		}
+		// the command is not started if the first rendering fails
+		if _, err := renderOnce(); err != nil {
+			log.Print("render: ", err)
+			os.Exit(exitCodeOf(err))
+		}
+		code, err := supervise(args)
+		if err != nil {
+			log.Print("supervise: ", err)
+			os.Exit(6)
+		}
+		os.Exit(code)
 	}
 
-	env, _ := retrieveEnv(t)
-	// if len(missings) != 0 {
-	// 	fmt.Println("Some fields are missing in env : ", missings)
-	// }
+	if command == "diff" || *checkOnly {
+		t, env, _, err := prepareRendering()
+		if err != nil {
+			log.Println(err)
+			os.Exit(exitCodeOf(err))
+		}
+		var out io.Writer
+		if command == "diff" {
+			out = os.Stdout
+		}
+		drift, err := diffTemplate(t, env, out)
+		if err != nil {
+			log.Print("diff: ", err)
+			os.Exit(3)
+		}
+		if drift && *checkOnly {
+			os.Exit(4)
+		}
+		return
+	}
 
-	parseTemplate(t, env)
+	result, err := renderThenExec(flag.Args(), execCommand) // exec mode with a command, it replaces dkconf
+	if err != nil {
+		if _, ok := err.(*exitError); ok {
+			log.Println(err)
+		}
+		os.Exit(exitCodeOf(err))
+	}
 
+	if result.changed && *changedExit != 0 {
+		os.Exit(*changedExit)
+	}
 }
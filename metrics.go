@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//renderMetrics counters of the renderings done in long-running modes
+type renderMetrics struct {
+	sync.Mutex
+	renders     int
+	failures    int
+	changes     int
+	durationSum time.Duration
+	missing     int
+	lastSuccess time.Time
+	lastFailed  bool
+}
+
+var metrics renderMetrics
+
+//recordRender record the outcome of a rendering
+func recordRender(result renderResult, err error) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.renders++
+	metrics.durationSum += result.duration
+	metrics.lastFailed = err != nil
+	if err != nil {
+		metrics.failures++
+		return
+	}
+	if result.changed {
+		metrics.changes++
+	}
+	metrics.missing = len(result.missing)
+	metrics.lastSuccess = time.Now()
+}
+
+//startStatusServer listen on addr and serve the status endpoints in background
+func startStatusServer(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Print("status server: ", http.Serve(l, statusHandler()))
+	}()
+	return nil
+}
+
+//statusHandler serve /healthz, /livez, /readyz and /metrics
+func statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { // the last rendering succeeded
+		metrics.Lock()
+		ok := !metrics.lastSuccess.IsZero() && !metrics.lastFailed
+		metrics.Unlock()
+		writeProbe(w, ok)
+	})
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) { // liveness, a failed rendering is retried
+		writeProbe(w, true)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) { // the target exists once rendered
+		metrics.Lock()
+		ok := !metrics.lastSuccess.IsZero()
+		metrics.Unlock()
+		writeProbe(w, ok)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	return mux
+}
+
+func writeProbe(w http.ResponseWriter, ok bool) {
+	if !ok {
+		http.Error(w, "not ok", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+//writeMetrics write the metrics in the prometheus text format
+func writeMetrics(w io.Writer) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	labels := fmt.Sprintf("{template=%q}", templateName())
+	var lastSuccess float64
+	if !metrics.lastSuccess.IsZero() {
+		lastSuccess = float64(metrics.lastSuccess.UnixNano()) / 1e9
+	}
+
+	fmt.Fprintln(w, "# HELP dkconf_renders_total Number of renderings.")
+	fmt.Fprintln(w, "# TYPE dkconf_renders_total counter")
+	fmt.Fprintf(w, "dkconf_renders_total%s %d\n", labels, metrics.renders)
+	fmt.Fprintln(w, "# HELP dkconf_render_failures_total Number of failed renderings.")
+	fmt.Fprintln(w, "# TYPE dkconf_render_failures_total counter")
+	fmt.Fprintf(w, "dkconf_render_failures_total%s %d\n", labels, metrics.failures)
+	fmt.Fprintln(w, "# HELP dkconf_target_changes_total Number of renderings which changed the target.")
+	fmt.Fprintln(w, "# TYPE dkconf_target_changes_total counter")
+	fmt.Fprintf(w, "dkconf_target_changes_total%s %d\n", labels, metrics.changes)
+	fmt.Fprintln(w, "# HELP dkconf_render_duration_seconds Duration of the renderings.")
+	fmt.Fprintln(w, "# TYPE dkconf_render_duration_seconds summary")
+	fmt.Fprintf(w, "dkconf_render_duration_seconds_sum%s %g\n", labels, metrics.durationSum.Seconds())
+	fmt.Fprintf(w, "dkconf_render_duration_seconds_count%s %d\n", labels, metrics.renders)
+	fmt.Fprintln(w, "# HELP dkconf_missing_variables Number of missing variables in the last successful rendering.")
+	fmt.Fprintln(w, "# TYPE dkconf_missing_variables gauge")
+	fmt.Fprintf(w, "dkconf_missing_variables%s %d\n", labels, metrics.missing)
+	fmt.Fprintln(w, "# HELP dkconf_last_success_timestamp_seconds Time of the last successful rendering.")
+	fmt.Fprintln(w, "# TYPE dkconf_last_success_timestamp_seconds gauge")
+	fmt.Fprintf(w, "dkconf_last_success_timestamp_seconds%s %g\n", labels, lastSuccess)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getStatus(path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	statusHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestStatusEndpoints(t *testing.T) {
+	metrics = renderMetrics{}
+	defer func() { metrics = renderMetrics{} }()
+	*sourceTplFile = "/tmp/nginx.tmpl"
+
+	if w := getStatus("/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Should not be ready before a rendering, got %d", w.Code)
+	}
+	if w := getStatus("/healthz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Should not be healthy before a rendering, got %d", w.Code)
+	}
+	if w := getStatus("/livez"); w.Code != http.StatusOK {
+		t.Errorf("Should be alive before a rendering, got %d", w.Code)
+	}
+
+	recordRender(renderResult{changed: true, missing: []string{"APPCONF_A", "APPCONF_B"}, duration: time.Second}, nil)
+	if w := getStatus("/healthz"); w.Code != http.StatusOK {
+		t.Errorf("Should be healthy after a successful rendering, got %d", w.Code)
+	}
+	recordRender(renderResult{duration: time.Second}, errors.New("boom"))
+
+	if w := getStatus("/readyz"); w.Code != http.StatusOK {
+		t.Errorf("Should be ready after a successful rendering, got %d", w.Code)
+	}
+	if w := getStatus("/healthz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Should not be healthy after a failed rendering, got %d", w.Code)
+	}
+	if w := getStatus("/livez"); w.Code != http.StatusOK {
+		t.Errorf("Should be alive after a failed rendering, got %d", w.Code)
+	}
+
+	body := getStatus("/metrics").Body.String()
+	for _, line := range []string{
+		`dkconf_renders_total{template="nginx.tmpl"} 2`,
+		`dkconf_render_failures_total{template="nginx.tmpl"} 1`,
+		`dkconf_target_changes_total{template="nginx.tmpl"} 1`,
+		`dkconf_render_duration_seconds_sum{template="nginx.tmpl"} 2`,
+		`dkconf_missing_variables{template="nginx.tmpl"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Metrics should contain [%s], got :\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"text/template"
+	"time"
+)
+
+//renderer a parsed source template, whatever its engine
+type renderer interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+//renderResult outcome of a rendering cycle
+type renderResult struct {
+	changed  bool
+	missing  []string
+	checksum string
+	duration time.Duration
+}
+
+//exitError an error with the exit code dkconf should use
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+//exitCode return the exit code matching err
+func exitCodeOf(err error) int {
+	switch e := err.(type) {
+	case *exitError:
+		return e.code
+	case *hookError:
+		return 5
+	}
+	return 3
+}
+
+//prepareRendering check the source, initialize the template with its engine and retrieve the values it uses
+func prepareRendering() (renderer, map[string]interface{}, []string, error) {
+	if !isRemoteSource(*sourceTplFile) && !checkFileExists(*sourceTplFile) {
+		return nil, nil, nil, &exitError{1, fmt.Errorf("Source Template File does not exists : %s", *sourceTplFile)}
+	}
+	if err := checkFormat(); err != nil {
+		return nil, nil, nil, &exitError{2, err}
+	}
+	switch *engine {
+	case "go":
+	case "envsubst":
+		return prepareEnvsubst()
+	case "jinja":
+		return prepareJinja()
+	default:
+		return nil, nil, nil, &exitError{2, fmt.Errorf("unknown template engine %s", *engine)}
+	}
+	t, err := initializeTemplate()
+	if err != nil {
+		return nil, nil, nil, &exitError{2, fmt.Errorf("Cannot initialize template du to error : %s", err)}
+	}
+	if err := ensureRemoteValues(); err != nil {
+		return nil, nil, nil, &exitError{3, fmt.Errorf("remote values: %s", err)}
+	}
+	env, missing, err := retrieveExpandedValues(t, *envPrefix, lookupValue)
+	if err != nil {
+		return nil, nil, nil, &exitError{3, err}
+	}
+	if htmlMode() {
+		h, err := htmlTemplate(t)
+		if err != nil {
+			return nil, nil, nil, &exitError{2, fmt.Errorf("Cannot initialize template du to error : %s", err)}
+		}
+		return h, env, missing, nil
+	}
+	if *strictEscape {
+		autoEscape(t)
+	}
+	return t, env, missing, nil
+}
+
+//retrieveExpandedValues retrieve the values used by t, expanding their references with -expand
+//and rendering those containing templates with -render-values
+func retrieveExpandedValues(t *template.Template, prefix string, lookup func(string) (string, bool)) (map[string]interface{}, []string, error) {
+	lookup, expandErr := expandingLookup(lookup)
+	env, missing := retrieveValues(t, prefix, lookup)
+	if *tplValues {
+		valueMissing, err := renderValueTemplates(t, env, prefix, lookup)
+		if err != nil {
+			return nil, nil, err
+		}
+		missing = append(missing, valueMissing...)
+		RemoveDuplicates(&missing)
+	}
+	if err := expandErr(); err != nil {
+		return nil, nil, err
+	}
+	return env, missing, nil
+}
+
+//renderOnce run a full rendering cycle, record its outcome in the metrics and send the render event
+func renderOnce() (renderResult, error) {
+	start := time.Now()
+	result, err := renderTarget()
+	result.duration = time.Since(start)
+	recordRender(result, err)
+	sendRenderEvent(result, err)
+	return result, err
+}
+
+//renderTarget template initialization, env lookup and target writing
+func renderTarget() (renderResult, error) {
+	var result renderResult
+	t, env, missing, err := prepareRendering()
+	if err != nil {
+		return result, err
+	}
+	result.missing = missing
+	result.changed, err = processTemplate(t, env)
+	if *targetFile != "" {
+		result.checksum = fileChecksum(*targetFile)
+	}
+	if cerr := reportChange(result.changed); cerr != nil && err == nil {
+		err = fmt.Errorf("changed file: %s", cerr)
+	}
+	return result, err
+}
+
+//fileChecksum return the sha256 of the file at path, or an empty string if it cannot be read
+func fileChecksum(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+//templateName name of the source template used in metrics and events
+func templateName() string {
+	return sourceName(*sourceTplFile)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func listenNotifySocket(t *testing.T) (*net.UnixConn, func()) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Cannot listen on %s: %s", socket, err)
+	}
+	os.Setenv("NOTIFY_SOCKET", socket)
+	return conn, func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("No notification received: %s", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	conn, cleanup := listenNotifySocket(t)
+	defer cleanup()
+
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("Notify should succeed, got %v", err)
+	}
+	if state := readNotification(t, conn); state != "READY=1" {
+		t.Errorf("Notification should be [READY=1], got [%s]", state)
+	}
+}
+
+func TestSdNotifyWithoutSocket(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("Notify without socket should be a no-op, got %v", err)
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Setenv("WATCHDOG_USEC", "2000000")
+	if d := sdWatchdogInterval(); d != time.Second {
+		t.Errorf("Watchdog should be pinged every second, got %s", d)
+	}
+	os.Setenv("WATCHDOG_PID", "1")
+	if d := sdWatchdogInterval(); d != 0 {
+		t.Errorf("Watchdog for another pid should be disabled, got %s", d)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if d := sdWatchdogInterval(); d != time.Second {
+		t.Errorf("Watchdog for our pid should be enabled, got %s", d)
+	}
+}
+
+func TestWatchLoopNotifiesSystemd(t *testing.T) {
+	conn, cleanup := listenNotifySocket(t)
+	defer cleanup()
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	*sourceTplFile, *targetFile = filepath.Join(dir, "app.tmpl"), filepath.Join(dir, "app.conf")
+	*pollInterval, *debounceDelay = 10*time.Millisecond, 20*time.Millisecond
+	defer func() {
+		*targetFile = ""
+		*pollInterval, *debounceDelay = time.Second, 500*time.Millisecond
+	}()
+	ioutil.WriteFile(*sourceTplFile, []byte("v1"), 0644)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchLoop(stop, nil)
+
+	if state := readNotification(t, conn); state != "READY=1" {
+		t.Errorf("First notification should be [READY=1], got [%s]", state)
+	}
+	ioutil.WriteFile(*sourceTplFile, []byte("v2"), 0644)
+	if state := readNotification(t, conn); state != "RELOADING=1" {
+		t.Errorf("Second notification should be [RELOADING=1], got [%s]", state)
+	}
+	if state := readNotification(t, conn); state != "READY=1" {
+		t.Errorf("Third notification should be [READY=1], got [%s]", state)
+	}
+}
+
+func TestWatchdogPingedByWatchLoop(t *testing.T) {
+	conn, cleanup := listenNotifySocket(t)
+	defer cleanup()
+	os.Setenv("WATCHDOG_USEC", "20000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	*sourceTplFile, *targetFile = filepath.Join(dir, "app.tmpl"), filepath.Join(dir, "app.conf")
+	defer func() { *targetFile = "" }()
+	ioutil.WriteFile(*sourceTplFile, []byte("v1"), 0644)
+
+	stop, release := make(chan struct{}), make(chan struct{})
+	defer close(stop)
+	go watchLoop(stop, func(changed bool) { <-release }) // the loop is stuck until released
+
+	if state := readNotification(t, conn); state != "READY=1" {
+		t.Errorf("First notification should be [READY=1], got [%s]", state)
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 256)); err == nil {
+		t.Errorf("Watchdog should not be pinged while the loop is stuck, got %d bytes", n)
+	}
+	close(release)
+	if state := readNotification(t, conn); state != "WATCHDOG=1" {
+		t.Errorf("Watchdog should be pinged once the loop runs again, got [%s]", state)
+	}
+}
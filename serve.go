@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const (
+	maxRenderRequestSize = 1 << 20
+	defaultServeAddr     = ":8080"
+)
+
+//renderRequest body of a render request, values are env var names and values
+type renderRequest struct {
+	Template string            `json:"template"`
+	Name     string            `json:"name"`
+	Prefix   string            `json:"prefix"`
+	Values   map[string]string `json:"values"`
+}
+
+//renderHandler serve POST /render, each request is rendered with its own values only,
+//neither the environment of the server nor the memoized env lists are used
+func renderHandler(templatesDir string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/render", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req renderRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRenderRequestSize)).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %s", err), http.StatusBadRequest)
+			return
+		}
+		content, missing, status, err := renderRequestTemplate(req, templatesDir)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Dkconf-Missing", strings.Join(missing, ","))
+		w.Write(content)
+	})
+	return mux
+}
+
+//renderRequestTemplate render the template of req, returns the http status to use on error
+func renderRequestTemplate(req renderRequest, templatesDir string) ([]byte, []string, int, error) {
+	if req.Prefix == "" {
+		req.Prefix = *envPrefix
+	}
+	var environ []string
+	for key, val := range req.Values {
+		environ = append(environ, key+"="+val)
+	}
+	env, globalEnv := buildEnvFrom(environ, req.Prefix), buildGlobalEnvFrom(environ)
+	lookup := func(key string) (string, bool) {
+		val, ok := req.Values[key]
+		return val, ok
+	}
+
+	t := template.New("request")
+	var err error
+	switch {
+	case req.Name != "":
+		if templatesDir == "" || filepath.Base(req.Name) != req.Name {
+			return nil, nil, http.StatusNotFound, fmt.Errorf("unknown template %s", req.Name)
+		}
+		path := filepath.Join(templatesDir, req.Name)
+		if !checkFileExists(path) {
+			return nil, nil, http.StatusNotFound, fmt.Errorf("unknown template %s", req.Name)
+		}
+		t = template.New(req.Name)
+		prepareTemplateWith(t, mapValue(env), mapValue(globalEnv))
+		t, err = t.ParseFiles(path)
+	default:
+		prepareTemplateWith(t, mapValue(env), mapValue(globalEnv))
+		t, err = t.Parse(req.Template)
+	}
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+
+	config, missing, err := retrieveExpandedValues(t, req.Prefix, lookup)
+	if err != nil {
+		return nil, nil, http.StatusUnprocessableEntity, err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, config); err != nil {
+		return nil, nil, http.StatusUnprocessableEntity, err
+	}
+	return buf.Bytes(), missing, http.StatusOK, nil
+}
+
+//mapValue return an env function looking up keys in m
+func mapValue(m map[string]interface{}) func(string) interface{} {
+	return func(key string) interface{} {
+		return m[slugify(key)]
+	}
+}
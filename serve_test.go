@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func postRender(handler http.Handler, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/render", strings.NewReader(body)))
+	return w
+}
+
+func TestServeRenderInlineTemplate(t *testing.T) {
+	os.Setenv("NGX_SERVER_ONLY", "leaked")
+	defer os.Unsetenv("NGX_SERVER_ONLY")
+
+	w := postRender(renderHandler(""), `{
+		"template": "{{ .Fqdn }} {{ .CorsEnabled }} {{ join .Names \",\" }} {{ \"fqdn\"|env }} [{{ \"server_only\"|env }}] {{ .Missing }}",
+		"prefix": "NGX",
+		"values": {"NGX_FQDN": "tutu.com", "NGX_CORS_ENABLED": "true", "NGX_NAMES": "a,b"}
+	}`)
+
+	wanted := "tutu.com true a,b tutu.com [<no value>] " + strings.Replace(missingVarStr, "%s", "Missing", 1)
+	wanted = strings.Replace(wanted, "%s", "NGX_MISSING", 1)
+	if w.Code != http.StatusOK || w.Body.String() != wanted {
+		t.Errorf("Render should return [%s], got %d [%s]", wanted, w.Code, w.Body.String())
+	}
+	if missing := w.Header().Get("X-Dkconf-Missing"); missing != "NGX_MISSING" {
+		t.Errorf("Missing header should be [NGX_MISSING], got [%s]", missing)
+	}
+}
+
+func TestServeRenderNamedTemplate(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "vhost.tmpl"), []byte("server_name {{ .Fqdn }};"), 0644)
+	handler := renderHandler(dir)
+
+	w := postRender(handler, `{"name": "vhost.tmpl", "values": {"APPCONF_FQDN": "tutu.com"}}`)
+	if w.Code != http.StatusOK || w.Body.String() != "server_name tutu.com;" {
+		t.Errorf("Named template should be rendered, got %d [%s]", w.Code, w.Body.String())
+	}
+
+	for _, name := range []string{"unknown.tmpl", "../vhost.tmpl"} {
+		if w := postRender(handler, `{"name": "`+name+`"}`); w.Code != http.StatusNotFound {
+			t.Errorf("Template %s should not be found, got %d", name, w.Code)
+		}
+	}
+}
+
+func TestServeRenderErrors(t *testing.T) {
+	handler := renderHandler("")
+	if w := postRender(handler, `{"template": "{{ .A "}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Bad template should be rejected, got %d", w.Code)
+	}
+	if w := postRender(handler, `not json`); w.Code != http.StatusBadRequest {
+		t.Errorf("Bad json should be rejected, got %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/render", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET should not be allowed, got %d", w.Code)
+	}
+}
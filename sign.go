@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// signatures, public and secret keys use the minisign formats, secret keys are not encrypted (minisign -W)
+
+const (
+	signatureSuffix      = ".minisig"
+	untrustedCommentLine = "untrusted comment: "
+	trustedCommentLine   = "trusted comment: "
+	secretKeyMode        = 0600
+)
+
+var (
+	legacyAlg    = []byte("Ed") // signature of the file itself
+	prehashedAlg = []byte("ED") // signature of the BLAKE2b-512 hash of the file
+	noKdfAlg     = []byte{0, 0}
+	checksumAlg  = []byte("B2")
+)
+
+//readMinisignLines read the base64 encoded lines of a minisign file, comments being returned apart
+func readMinisignLines(path string) ([][]byte, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var data [][]byte
+	var comments []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", strings.HasPrefix(line, untrustedCommentLine):
+		case strings.HasPrefix(line, trustedCommentLine):
+			comments = append(comments, strings.TrimPrefix(line, trustedCommentLine))
+		default:
+			decoded, err := base64.StdEncoding.DecodeString(line)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %s", path, err)
+			}
+			data = append(data, decoded)
+		}
+	}
+	return data, comments, scanner.Err()
+}
+
+//readPublicKey read a minisign public key file
+func readPublicKey(path string) ([]byte, ed25519.PublicKey, error) {
+	data, _, err := readMinisignLines(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) != 1 || len(data[0]) != 2+8+ed25519.PublicKeySize || !bytes.Equal(data[0][:2], legacyAlg) {
+		return nil, nil, fmt.Errorf("%s: not a minisign public key", path)
+	}
+	return data[0][2:10], ed25519.PublicKey(data[0][10:]), nil
+}
+
+//readSecretKey read an unencrypted minisign secret key file
+func readSecretKey(path string) ([]byte, ed25519.PrivateKey, error) {
+	data, _, err := readMinisignLines(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	const size = 2 + 2 + 2 + 32 + 8 + 8 + 8 + ed25519.PrivateKeySize + 32
+	if len(data) != 1 || len(data[0]) != size || !bytes.Equal(data[0][:2], legacyAlg) {
+		return nil, nil, fmt.Errorf("%s: not a minisign secret key", path)
+	}
+	key := data[0]
+	if !bytes.Equal(key[2:4], noKdfAlg) {
+		return nil, nil, fmt.Errorf("%s: encrypted secret keys are not supported, generate it with minisign -W", path)
+	}
+	keynum := key[54:]
+	keyID, secret, checksum := keynum[:8], keynum[8:8+ed25519.PrivateKeySize], keynum[8+ed25519.PrivateKeySize:]
+	if !bytes.Equal(checksum, secretKeyChecksum(keyID, secret)) {
+		return nil, nil, fmt.Errorf("%s: wrong secret key checksum", path)
+	}
+	return keyID, ed25519.PrivateKey(secret), nil
+}
+
+func secretKeyChecksum(keyID []byte, secret []byte) []byte {
+	sum := blake2b.Sum256(concatBytes(legacyAlg, keyID, secret))
+	return sum[:]
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, part := range parts {
+		buf.Write(part)
+	}
+	return buf.Bytes()
+}
+
+//generateKeys write a new unencrypted minisign key pair, existing keys are only overwritten with force
+func generateKeys(secretPath string, publicPath string, force bool) error {
+	public, secret, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	keyID := make([]byte, 8)
+	if _, err := rand.Read(keyID); err != nil {
+		return err
+	}
+	id := fmt.Sprintf("%X", reverseBytes(keyID))
+
+	secretKey := concatBytes(legacyAlg, noKdfAlg, checksumAlg, make([]byte, 32+8+8), keyID, secret, secretKeyChecksum(keyID, secret))
+	secretContent := fmt.Sprintf("%sminisign encrypted secret key %s\n%s\n", untrustedCommentLine, id, base64.StdEncoding.EncodeToString(secretKey))
+	if err := writeKeyFile(secretPath, []byte(secretContent), secretKeyMode, force); err != nil {
+		return err
+	}
+	publicContent := fmt.Sprintf("%sminisign public key %s\n%s\n", untrustedCommentLine, id, base64.StdEncoding.EncodeToString(concatBytes(legacyAlg, keyID, public)))
+	if err := writeKeyFile(publicPath, []byte(publicContent), defaultTargetMode, force); err != nil {
+		if !force { // the new secret key is useless without its public key
+			os.Remove(secretPath)
+		}
+		return err
+	}
+	return nil
+}
+
+//writeKeyFile write a key file, failing if it already exists unless force
+func writeKeyFile(path string, content []byte, mode os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, mode)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", path)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+//reverseBytes minisign displays key ids as little endian numbers
+func reverseBytes(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+//signFile write the prehashed minisign signature of path in path.minisig
+func signFile(path string, secretPath string) error {
+	keyID, secret, err := readSecretKey(secretPath)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	hash := blake2b.Sum512(content)
+	signature := ed25519.Sign(secret, hash[:])
+	trusted := fmt.Sprintf("timestamp:%d\tfile:%s\thashed", time.Now().Unix(), filepath.Base(path))
+	global := ed25519.Sign(secret, concatBytes(signature, []byte(trusted)))
+
+	signatureContent := fmt.Sprintf("%ssignature from dkconf secret key\n%s\n%s%s\n%s\n",
+		untrustedCommentLine,
+		base64.StdEncoding.EncodeToString(concatBytes(prehashedAlg, keyID, signature)),
+		trustedCommentLine, trusted,
+		base64.StdEncoding.EncodeToString(global))
+	return ioutil.WriteFile(path+signatureSuffix, []byte(signatureContent), defaultTargetMode)
+}
+
+//verifyFile check the minisign signature of the file at path with the public key
+func verifyFile(path string, signaturePath string, publicPath string) error {
+	publicID, public, err := readPublicKey(publicPath)
+	if err != nil {
+		return err
+	}
+	data, comments, err := readMinisignLines(signaturePath)
+	if err != nil {
+		return err
+	}
+	if len(data) != 2 || len(comments) != 1 || len(data[0]) != 2+8+ed25519.SignatureSize || len(data[1]) != ed25519.SignatureSize {
+		return fmt.Errorf("%s: not a minisign signature", signaturePath)
+	}
+	alg, keyID, signature := data[0][:2], data[0][2:10], data[0][10:]
+	if !bytes.Equal(keyID, publicID) {
+		return fmt.Errorf("%s: signed with another key (%X)", signaturePath, reverseBytes(keyID))
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case bytes.Equal(alg, prehashedAlg):
+		hash := blake2b.Sum512(content)
+		content = hash[:]
+	case !bytes.Equal(alg, legacyAlg):
+		return fmt.Errorf("%s: unknown signature algorithm", signaturePath)
+	}
+	if !ed25519.Verify(public, content, signature) {
+		return errors.New("signature verification failed for " + path)
+	}
+	if !ed25519.Verify(public, concatBytes(signature, []byte(comments[0])), data[1]) {
+		return errors.New("trusted comment verification failed for " + path)
+	}
+	return nil
+}
+
+//verifySource check the signature of the source template src, cached at local for remote ones
+func verifySource(src string, local string) error {
+	signature := local + signatureSuffix
+	if isRemoteSource(src) {
+		var err error
+		if signature, err = fetchTemplate(src+signatureSuffix, ""); err != nil {
+			return err
+		}
+	}
+	return verifyFile(local, signature, *verifyKey)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	secret, public := filepath.Join(dir, "dkconf.key"), filepath.Join(dir, "dkconf.pub")
+	template := filepath.Join(dir, "nginx.tmpl")
+	ioutil.WriteFile(template, []byte("server_name {{ .Fqdn }};"), 0644)
+
+	if err := generateKeys(secret, public, false); err != nil {
+		t.Fatalf("Keys generation should succeed, got %v", err)
+	}
+	if fi, _ := os.Stat(secret); fi.Mode().Perm() != secretKeyMode {
+		t.Errorf("Secret key should only be readable by its owner, got %v", fi.Mode().Perm())
+	}
+	if err := signFile(template, secret); err != nil {
+		t.Fatalf("Signature should succeed, got %v", err)
+	}
+	if err := verifyFile(template, template+signatureSuffix, public); err != nil {
+		t.Errorf("Signature should be verified, got %v", err)
+	}
+
+	ioutil.WriteFile(template, []byte("server_name evil.com;"), 0644)
+	if err := verifyFile(template, template+signatureSuffix, public); err == nil {
+		t.Error("Signature of a modified template should not be verified")
+	}
+
+	other := filepath.Join(dir, "other.key")
+	generateKeys(other, filepath.Join(dir, "other.pub"), false)
+	signFile(template, other)
+	if err := verifyFile(template, template+signatureSuffix, public); err == nil {
+		t.Error("Signature with another key should not be verified")
+	}
+}
+
+func TestGenerateKeysKeepsExistingKeys(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	secret, public := filepath.Join(dir, "dkconf.key"), filepath.Join(dir, "dkconf.pub")
+	generateKeys(secret, public, false)
+	before := readFile(secret)
+
+	if err := generateKeys(secret, public, false); err == nil {
+		t.Error("Keys generation should fail when the secret key exists")
+	}
+	if readFile(secret) != before {
+		t.Error("Existing secret key should not be overwritten")
+	}
+
+	os.Remove(secret)
+	if err := generateKeys(secret, public, false); err == nil || checkFileExists(secret) {
+		t.Errorf("Keys generation should fail without leaving a secret key when the public key exists, got %v", err)
+	}
+
+	generateKeys(secret, public, false)
+	before = readFile(secret)
+	if err := generateKeys(secret, public, true); err != nil || readFile(secret) == before {
+		t.Errorf("Keys should be overwritten with force, got %v", err)
+	}
+}
+
+func TestVerifyLegacySignature(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	public, secret, _ := ed25519.GenerateKey(nil)
+	keyID := []byte("12345678")
+	publicPath, template := filepath.Join(dir, "dkconf.pub"), filepath.Join(dir, "nginx.tmpl")
+	content := []byte("server_name {{ .Fqdn }};")
+	ioutil.WriteFile(template, content, 0644)
+	ioutil.WriteFile(publicPath, []byte("untrusted comment: minisign public key\n"+base64.StdEncoding.EncodeToString(concatBytes(legacyAlg, keyID, public))+"\n"), 0644)
+
+	// minisign -S -l signs the file itself
+	signature := ed25519.Sign(secret, content)
+	trusted := "timestamp:1\tfile:nginx.tmpl"
+	ioutil.WriteFile(template+signatureSuffix, []byte(fmt.Sprintf("untrusted comment: legacy\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(concatBytes(legacyAlg, keyID, signature)),
+		trusted,
+		base64.StdEncoding.EncodeToString(ed25519.Sign(secret, concatBytes(signature, []byte(trusted)))))), 0644)
+
+	if err := verifyFile(template, template+signatureSuffix, publicPath); err != nil {
+		t.Errorf("Legacy signature should be verified, got %v", err)
+	}
+}
+
+func TestInitializeTemplateRefusesUnsignedTemplate(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	secret, public := filepath.Join(dir, "dkconf.key"), filepath.Join(dir, "dkconf.pub")
+	generateKeys(secret, public, false)
+	*sourceTplFile = filepath.Join(dir, "nginx.tmpl")
+	*verifyKey = public
+	defer func() { *verifyKey = "" }()
+	ioutil.WriteFile(*sourceTplFile, []byte("{{ .Fqdn }}"), 0644)
+
+	if _, err := initializeTemplate(); err == nil {
+		t.Error("Template without signature should be refused")
+	}
+	signFile(*sourceTplFile, secret)
+	if _, err := initializeTemplate(); err != nil {
+		t.Errorf("Signed template should be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	remoteTimeout = 10 * time.Second
+)
+
+var (
+	remoteMutex sync.Mutex
+	// nil until the remote sources were fetched successfully, then the last good data
+	remoteValues map[string]string
+	remoteDigest string
+)
+
+//lookupValue look for key in the environment, then in the remote values
+func lookupValue(key string) (string, bool) {
+	if val, ok := os.LookupEnv(key); ok {
+		return val, ok
+	}
+	remoteMutex.Lock()
+	defer remoteMutex.Unlock()
+	val, ok := remoteValues[key]
+	return val, ok
+}
+
+//environ list the environment merged with the remote values, in the key=value form of os.Environ
+func environ() []string {
+	env := os.Environ()
+	remoteMutex.Lock()
+	defer remoteMutex.Unlock()
+	for key, val := range remoteValues {
+		if _, ok := os.LookupEnv(key); !ok { // the environment wins
+			env = append(env, key+"="+val)
+		}
+	}
+	return env
+}
+
+//currentRemoteDigest return the digest of the last good remote values
+func currentRemoteDigest() string {
+	remoteMutex.Lock()
+	defer remoteMutex.Unlock()
+	return remoteDigest
+}
+
+//fetchValues fetch a JSON object of values from url, vault like {"data": {...}} envelopes are unwrapped
+func fetchValues(url string) (map[string]string, error) {
+	client := http.Client{Timeout: remoteTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	var data map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("%s: %s", url, err)
+	}
+	for len(data) == 1 {
+		inner, ok := data["data"].(map[string]interface{})
+		if !ok {
+			break
+		}
+		data = inner
+	}
+	values := make(map[string]string)
+	for key, val := range data {
+		values[key] = valueString(val)
+	}
+	return values, nil
+}
+
+//valueString format a JSON value as an env var value, arrays become comma separated lists
+func valueString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case []interface{}:
+		items := make([]string, len(val))
+		for i, item := range val {
+			items[i] = valueString(item)
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+//digestValues hash values in a stable way
+func digestValues(values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s=%q\n", key, values[key])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+//updateRemoteValues fetch all remote sources, later ones overriding earlier ones, and keep the result
+//only if every source succeeded, returns true when the data changed
+func updateRemoteValues() (bool, error) {
+	values := make(map[string]string)
+	for _, url := range valuesURLs {
+		fetched, err := fetchValues(url)
+		if err != nil {
+			return false, err
+		}
+		for key, val := range fetched {
+			values[key] = val
+		}
+	}
+	digest := digestValues(values)
+
+	remoteMutex.Lock()
+	defer remoteMutex.Unlock()
+	changed := digest != remoteDigest
+	remoteValues, remoteDigest = values, digest
+	return changed, nil
+}
+
+//ensureRemoteValues fetch the remote sources unless they were already fetched successfully
+func ensureRemoteValues() error {
+	remoteMutex.Lock()
+	fetched := remoteValues != nil
+	remoteMutex.Unlock()
+	if fetched || len(valuesURLs) == 0 {
+		return nil
+	}
+	_, err := updateRemoteValues()
+	return err
+}
+
+//jitter add up to 10% of random delay to d so that many instances do not poll in sync
+func jitter(d time.Duration) time.Duration {
+	if d < 10 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(d/10)))
+}
+
+//pollRemoteValues fetch the remote sources every interval until stop is closed,
+//errors are retried with an exponential backoff while the last good data is kept
+func pollRemoteValues(stop <-chan struct{}) {
+	var backoff time.Duration
+	for {
+		delay := jitter(*fetchInterval)
+		if backoff > 0 {
+			delay = backoff
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+
+		if _, err := updateRemoteValues(); err != nil {
+			backoff = nextBackoff(backoff)
+			log.Printf("remote values: %s, keeping last good data, retrying in %s", err, backoff)
+			continue
+		}
+		backoff = 0
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func resetRemoteValues() {
+	valuesURLs = nil
+	remoteValues, remoteDigest = nil, ""
+}
+
+func TestFetchValues(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"data": {"APPCONF_FQDN": "tutu.com", "APPCONF_NAMES": ["a", "b"], "APPCONF_CORS": true, "APPCONF_PORT": 80}}}`)
+	}))
+	defer server.Close()
+
+	values, err := fetchValues(server.URL)
+	if err != nil {
+		t.Fatalf("Fetch should succeed, got %v", err)
+	}
+	wanted := map[string]string{"APPCONF_FQDN": "tutu.com", "APPCONF_NAMES": "a,b", "APPCONF_CORS": "true", "APPCONF_PORT": "80"}
+	if digestValues(values) != digestValues(wanted) {
+		t.Errorf("Values are not equal want : %v, got : %v", wanted, values)
+	}
+}
+
+func TestRemoteValuesKeepLastGoodData(t *testing.T) {
+	fail := false
+	value := "one"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"APPCONF_REMOTE_VAR": %q}`, value)
+	}))
+	defer server.Close()
+	defer resetRemoteValues()
+	valuesURLs = stringList{server.URL}
+
+	if err := ensureRemoteValues(); err != nil {
+		t.Fatalf("First fetch should succeed, got %v", err)
+	}
+	if val, _ := lookupValue("APPCONF_REMOTE_VAR"); val != "one" {
+		t.Errorf("Remote value should be [one], got [%s]", val)
+	}
+
+	if changed, _ := updateRemoteValues(); changed {
+		t.Error("Same data should not be reported as changed")
+	}
+
+	fail = true
+	if _, err := updateRemoteValues(); err == nil {
+		t.Error("Fetch should fail")
+	}
+	if val, _ := lookupValue("APPCONF_REMOTE_VAR"); val != "one" {
+		t.Errorf("Last good value should be kept, got [%s]", val)
+	}
+
+	fail, value = false, "two"
+	if changed, _ := updateRemoteValues(); !changed {
+		t.Error("New data should be reported as changed")
+	}
+
+	os.Setenv("APPCONF_REMOTE_VAR", "env")
+	defer os.Unsetenv("APPCONF_REMOTE_VAR")
+	if val, _ := lookupValue("APPCONF_REMOTE_VAR"); val != "env" {
+		t.Errorf("Environment should win over remote values, got [%s]", val)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Second); d < time.Second || d >= 1100*time.Millisecond {
+			t.Fatalf("Jitter should add at most 10%%, got %s", d)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var (
+	signalNames = map[string]syscall.Signal{
+		"HUP":   syscall.SIGHUP,
+		"INT":   syscall.SIGINT,
+		"QUIT":  syscall.SIGQUIT,
+		"USR1":  syscall.SIGUSR1,
+		"USR2":  syscall.SIGUSR2,
+		"TERM":  syscall.SIGTERM,
+		"WINCH": syscall.SIGWINCH,
+	}
+	// SIGHUP is not forwarded, it forces a new rendering
+	forwardedSignals = []os.Signal{
+		syscall.SIGINT,
+		syscall.SIGQUIT,
+		syscall.SIGUSR1,
+		syscall.SIGUSR2,
+		syscall.SIGTERM,
+		syscall.SIGWINCH,
+	}
+	// held while dkconf waits for a command it started, as pid 1 reaping every exited process would steal its status
+	childLock sync.Mutex
+)
+
+//supervisedChild the supervised command, only signaled until it is reaped as its pid may then be reused
+type supervisedChild struct {
+	cmd    *exec.Cmd
+	exited bool
+}
+
+//parseSignal parse a signal name such as HUP or SIGUSR2
+func parseSignal(name string) (syscall.Signal, error) {
+	if sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %s", name)
+}
+
+//supervise start args as a child process, forward it the signals received and send it reloadSignal
+//each time the watched inputs are rendered into a new target, returns the exit code of the child
+func supervise(args []string) (int, error) {
+	sig, err := parseSignal(*reloadSignal)
+	if err != nil {
+		return 0, err
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return 0, err
+	}
+
+	// registered before starting the child so its exit cannot be missed
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals, append(forwardedSignals, syscall.SIGCHLD)...)
+	defer signal.Stop(signals)
+
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	child := &supervisedChild{cmd: cmd}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(stop)
+		<-done // a rendering in progress is finished before returning
+	}()
+	go func() {
+		defer close(done)
+		watchLoop(stop, func(changed bool) {
+			if changed {
+				log.Printf("sending %s to %s", sig, args[0])
+				child.signal(sig)
+			}
+		})
+	}()
+
+	reapAll := os.Getpid() == 1 // as pid 1 we inherit orphans and must reap them
+	for s := range signals {
+		if s != syscall.SIGCHLD {
+			child.signal(s)
+			continue
+		}
+		if status, exited := child.reap(reapAll); exited {
+			return exitCode(status), nil
+		}
+	}
+	return 0, nil
+}
+
+//signal send s to the child unless it was already reaped
+func (c *supervisedChild) signal(s os.Signal) {
+	childLock.Lock()
+	defer childLock.Unlock()
+	if !c.exited {
+		c.cmd.Process.Signal(s)
+	}
+}
+
+//reap collect the exited processes, or only the child unless all, returns the status of the child once it exited
+func (c *supervisedChild) reap(all bool) (syscall.WaitStatus, bool) {
+	childLock.Lock()
+	defer childLock.Unlock()
+	pid := c.cmd.Process.Pid
+	if all {
+		pid = -1
+	}
+	for {
+		var status syscall.WaitStatus
+		wpid, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil)
+		if err != nil || wpid <= 0 {
+			return status, false
+		}
+		if wpid == c.cmd.Process.Pid {
+			c.exited = true
+			return status, true
+		}
+	}
+}
+
+//exitCode convert a wait status into an exit code, as a shell does
+func exitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseSignal(t *testing.T) {
+	for name, wanted := range map[string]syscall.Signal{"HUP": syscall.SIGHUP, "sigusr2": syscall.SIGUSR2, "SIGQUIT": syscall.SIGQUIT} {
+		if sig, err := parseSignal(name); err != nil || sig != wanted {
+			t.Errorf("Signal %s should be parsed into %s, got %s (%v)", name, wanted, sig, err)
+		}
+	}
+	if _, err := parseSignal("NOPE"); err == nil {
+		t.Error("Unknown signal should not be parsed")
+	}
+}
+
+func TestSuperviseExitCode(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	*sourceTplFile, *targetFile = filepath.Join(dir, "app.tmpl"), filepath.Join(dir, "app.conf")
+	defer func() { *targetFile = "" }()
+	ioutil.WriteFile(*sourceTplFile, []byte("v1"), 0644)
+	renderOnce()
+
+	code, err := supervise([]string{"sh", "-c", "exit 3"})
+	if err != nil || code != 3 {
+		t.Errorf("Supervise should return the child exit code 3, got %d (%v)", code, err)
+	}
+}
+
+func TestSuperviseSignalsChildAfterRender(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	*sourceTplFile, *targetFile = filepath.Join(dir, "app.tmpl"), filepath.Join(dir, "app.conf")
+	*reloadSignal = "USR1"
+	*pollInterval, *debounceDelay = 10*time.Millisecond, 20*time.Millisecond
+	defer func() {
+		*targetFile, *reloadSignal = "", "HUP"
+		*pollInterval, *debounceDelay = time.Second, 500*time.Millisecond
+	}()
+	ioutil.WriteFile(*sourceTplFile, []byte("v1"), 0644)
+	renderOnce()
+
+	reloads := filepath.Join(dir, "reloads")
+	script := "trap 'cat " + *targetFile + " >> " + reloads + "' USR1; trap 'exit 7' TERM; while true; do sleep 0.01; done"
+
+	result := make(chan int)
+	go func() {
+		code, _ := supervise([]string{"sh", "-c", script})
+		result <- code
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	ioutil.WriteFile(*sourceTplFile, []byte("v2"), 0644)
+	for i := 0; i < 200 && !strings.Contains(readFile(reloads), "v2"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if readFile(reloads) != "v2" {
+		t.Errorf("Child should be signaled once after the new rendering, got [%s]", readFile(reloads))
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM) // forwarded to the child
+	select {
+	case code := <-result:
+		if code != 7 {
+			t.Errorf("Supervise should return the child exit code 7, got %d", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Child did not exit on forwarded SIGTERM")
+	}
+}
+
+func readFile(path string) string {
+	content, _ := ioutil.ReadFile(path)
+	return string(content)
+}
+
+func TestReapWaitsForHooks(t *testing.T) {
+	cmd := exec.Command("sleep", "0.3")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	child := &supervisedChild{cmd: cmd}
+	hook := make(chan error, 1)
+	go func() { hook <- runHook("sleep 0.1", "") }()
+	time.Sleep(20 * time.Millisecond)
+
+	// reaping every exited process, as pid 1 does, must wait for the hook status to be collected by runHook
+	child.reap(true)
+	select {
+	case err := <-hook:
+		if err != nil {
+			t.Errorf("Hook should not be reaped by supervise, got %v", err)
+		}
+	case <-time.After(50 * time.Millisecond):
+		t.Error("Reaping should wait for the running hook")
+	}
+
+	for _, exited := child.reap(true); !exited; _, exited = child.reap(true) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	child.signal(syscall.SIGTERM) // a no-op once the child is reaped
+}
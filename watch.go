@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	maxBackoff = time.Minute
+)
+
+//watchedPaths list the files and directories whose changes trigger a new rendering
+func watchedPaths() []string {
+	paths := append([]string{*sourceTplFile}, extendedSources(*sourceTplFile)...)
+	paths = append(paths, includePaths...)
+	return append(paths, watchPaths...)
+}
+
+//checkWatchable check that the changes of the source template can be detected, a remote one being fetched every -interval
+func checkWatchable() error {
+	if isRemoteSource(*sourceTplFile) && *fetchInterval <= 0 {
+		return fmt.Errorf("watching the remote source template %s requires -interval", *sourceTplFile)
+	}
+	return nil
+}
+
+//fingerprint hash the content of paths, walking directories and recording symlinks targets
+//so that swaps of a kubernetes ConfigMap ..data symlink are detected, remote templates are hashed from their cached copy
+func fingerprint(paths []string) string {
+	h := sha256.New()
+	for _, path := range paths {
+		if isRemoteSource(path) {
+			fmt.Fprintf(h, "%s\n", path)
+			hashFile(h, cachedTemplate(path))
+			continue
+		}
+		filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintf(h, "%s missing\n", p)
+				return nil
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				link, _ := os.Readlink(p)
+				fmt.Fprintf(h, "%s -> %s\n", p, link)
+				if target, err := os.Stat(p); err == nil && target.Mode().IsRegular() {
+					hashFile(h, p)
+				}
+				return nil
+			}
+			if fi.Mode().IsRegular() {
+				fmt.Fprintf(h, "%s %o\n", p, fi.Mode().Perm())
+				hashFile(h, p)
+			}
+			return nil
+		})
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func hashFile(h hash.Hash, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	io.Copy(h, f)
+}
+
+//logReloadSummary log the targets changed by a rendering forced by SIGHUP
+func logReloadSummary(changed bool) {
+	if changed {
+		log.Printf("reload summary: 1 target changed: %s", *targetFile)
+	} else {
+		log.Print("reload summary: no target changed")
+	}
+}
+
+//nextBackoff double the delay before retrying a failed rendering
+func nextBackoff(d time.Duration) time.Duration {
+	if d < *pollInterval {
+		return *pollInterval
+	}
+	if d*2 > maxBackoff {
+		return maxBackoff
+	}
+	return d * 2
+}
+
+//watchLoop render then render again each time the watched paths change or SIGHUP is received, until stop is closed.
+//rendered is called after each successful rendering
+func watchLoop(stop <-chan struct{}, rendered func(changed bool)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var pollers sync.WaitGroup // waited for, so that nothing reads the flags once the loop returned
+	defer pollers.Wait()
+	if len(valuesURLs) > 0 && *fetchInterval > 0 {
+		pollers.Add(1)
+		go func() {
+			defer pollers.Done()
+			pollRemoteValues(stop)
+		}()
+	}
+	if isRemoteSource(*sourceTplFile) && *fetchInterval > 0 {
+		pollers.Add(1)
+		go func() {
+			defer pollers.Done()
+			pollRemoteSource(stop)
+		}()
+	}
+
+	paths := watchedPaths()
+	last, lastRemote := fingerprint(paths), currentRemoteDigest()
+	pending, forced, ready := true, false, false
+	var next time.Time
+	var backoff time.Duration
+
+	ticker := time.NewTicker(*pollInterval)
+	defer ticker.Stop()
+	var watchdog <-chan time.Time
+	if interval := sdWatchdogInterval(); interval > 0 { // pinged by the loop itself, so that systemd restarts it when stuck
+		watchdogTicker := time.NewTicker(interval)
+		defer watchdogTicker.Stop()
+		watchdog = watchdogTicker.C
+	}
+	for {
+		if pending && !time.Now().Before(next) {
+			if ready {
+				sdNotify("RELOADING=1")
+			}
+			result, err := renderOnce()
+			if err == nil || ready { // systemd is told the service is ready after the first successful rendering
+				ready = true
+				sdNotify("READY=1")
+			}
+			if err != nil {
+				backoff = nextBackoff(backoff)
+				next = time.Now().Add(backoff)
+				log.Printf("render failed, retrying in %s: %s", backoff, err)
+			} else {
+				pending, backoff = false, 0
+				if result.changed {
+					log.Printf("%s rendered", *targetFile)
+				}
+				if forced {
+					logReloadSummary(result.changed)
+				}
+				if rendered != nil {
+					rendered(result.changed)
+				}
+			}
+			forced = forced && err != nil
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-hup: // the whole environment snapshot is read again
+			log.Print("SIGHUP received, rendering everything again")
+			resetEnvs()
+			pending, forced, next = true, true, time.Time{}
+			continue
+		case <-watchdog:
+			sdNotify("WATCHDOG=1")
+			continue
+		case <-ticker.C:
+		}
+
+		if remote := currentRemoteDigest(); remote != lastRemote { // remote values are also seen by env functions
+			lastRemote = remote
+			resetEnvs()
+			pending = true
+			next = time.Now().Add(*debounceDelay)
+		}
+		if fp := fingerprint(paths); fp != last { // each change postpones the rendering to debounce bursts
+			last = fp
+			pending = true
+			next = time.Now().Add(*debounceDelay)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFingerprintDetectsSymlinkSwap(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+
+	// kubernetes ConfigMap layout : file -> ..data/file, ..data -> ..timestamped directory
+	os.Mkdir(filepath.Join(dir, "..v1"), 0755)
+	os.Mkdir(filepath.Join(dir, "..v2"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "..v1", "app.tmpl"), []byte("v1"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "..v2", "app.tmpl"), []byte("v2"), 0644)
+	os.Symlink("..v1", filepath.Join(dir, "..data"))
+	os.Symlink(filepath.Join("..data", "app.tmpl"), filepath.Join(dir, "app.tmpl"))
+
+	file := []string{filepath.Join(dir, "app.tmpl")}
+	before := fingerprint(file)
+	if before != fingerprint(file) {
+		t.Error("Fingerprint should be stable")
+	}
+
+	os.Symlink("..v2", filepath.Join(dir, "..data.tmp"))
+	os.Rename(filepath.Join(dir, "..data.tmp"), filepath.Join(dir, "..data"))
+
+	if before == fingerprint(file) {
+		t.Error("Fingerprint should change when the ..data symlink is swapped")
+	}
+}
+
+func TestFingerprintMissingFile(t *testing.T) {
+	paths := []string{filepath.Join(os.TempDir(), "dkconf-no-such-file")}
+	if fingerprint(paths) != fingerprint(paths) {
+		t.Error("Fingerprint of a missing file should be stable")
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	*pollInterval = time.Second
+	if d := nextBackoff(0); d != time.Second {
+		t.Errorf("First backoff should be the poll interval, got %s", d)
+	}
+	if d := nextBackoff(4 * time.Second); d != 8*time.Second {
+		t.Errorf("Backoff should double, got %s", d)
+	}
+	if d := nextBackoff(maxBackoff); d != maxBackoff {
+		t.Errorf("Backoff should be capped, got %s", d)
+	}
+}
+
+func TestWatchLoop(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	source, target := filepath.Join(dir, "app.tmpl"), filepath.Join(dir, "app.conf")
+	ioutil.WriteFile(source, []byte("v1"), 0644)
+
+	*sourceTplFile, *targetFile = source, target
+	*pollInterval, *debounceDelay = 10*time.Millisecond, 20*time.Millisecond
+	defer func() {
+		*sourceTplFile, *targetFile = "", ""
+		*pollInterval, *debounceDelay = time.Second, 500*time.Millisecond
+	}()
+
+	renders := make(chan bool, 10)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watchLoop(stop, func(changed bool) { renders <- changed })
+		close(done)
+	}()
+
+	assertRendered(t, renders, target, "v1")
+	ioutil.WriteFile(source, []byte("v2"), 0644)
+	assertRendered(t, renders, target, "v2")
+
+	close(stop)
+	<-done
+}
+
+func assertRendered(t *testing.T, renders chan bool, target string, wanted string) {
+	select {
+	case changed := <-renders:
+		content, _ := ioutil.ReadFile(target)
+		if !changed || string(content) != wanted {
+			t.Errorf("Target should be rendered into [%s], got changed=%v content=[%s]", wanted, changed, content)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Target was not rendered into [%s]", wanted)
+	}
+}
+
+func TestWatchLoopRendersOnSighup(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	source, target := filepath.Join(dir, "app.tmpl"), filepath.Join(dir, "app.conf")
+	ioutil.WriteFile(source, []byte(`{{ "dkconf_hup"|env }}`), 0644)
+	os.Setenv("APPCONF_DKCONF_HUP", "before")
+	defer os.Unsetenv("APPCONF_DKCONF_HUP")
+
+	*sourceTplFile, *targetFile = source, target
+	*pollInterval = 10 * time.Millisecond
+	resetEnvs() // the env lists memoized by another test would hide the value
+	defer func() {
+		*sourceTplFile, *targetFile = "", ""
+		*pollInterval = time.Second
+		resetEnvs()
+	}()
+
+	renders := make(chan bool, 10)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watchLoop(stop, func(changed bool) { renders <- changed })
+		close(done)
+	}()
+	assertRendered(t, renders, target, "before")
+
+	// memoized env lists are only built again on SIGHUP
+	os.Setenv("APPCONF_DKCONF_HUP", "after")
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	assertRendered(t, renders, target, "after")
+
+	close(stop)
+	<-done
+}
+
+func TestWatchLoopPollsRemoteSource(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	version := "v1"
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.Header.Get("If-None-Match") == `"`+version+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"`+version+`"`)
+		fmt.Fprint(w, version)
+	}))
+	defer server.Close()
+
+	*sourceTplFile, *targetFile, *cacheDir = server.URL+"/app.tmpl", filepath.Join(dir, "app.conf"), dir
+	*pollInterval, *debounceDelay, *fetchInterval = 10*time.Millisecond, 20*time.Millisecond, 0
+	defer func() {
+		*sourceTplFile, *targetFile, *cacheDir = "", "", ""
+		*pollInterval, *debounceDelay, *fetchInterval = time.Second, 500*time.Millisecond, 0
+	}()
+	if err := checkWatchable(); err == nil {
+		t.Error("Watching a remote source without -interval should be rejected")
+	}
+	*fetchInterval = 20 * time.Millisecond
+
+	renders := make(chan bool, 10)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watchLoop(stop, func(changed bool) {
+			if changed {
+				renders <- changed
+			}
+		})
+		close(done)
+	}()
+
+	assertRendered(t, renders, *targetFile, "v1")
+	lock.Lock()
+	version = "v2"
+	lock.Unlock()
+	assertRendered(t, renders, *targetFile, "v2")
+
+	close(stop)
+	<-done
+}
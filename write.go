@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTargetMode os.FileMode = 0644
+	backupSuffix                  = ".dkconf-bak."
+	backupTimeFormat              = "20060102T150405.000000000"
+)
+
+//renderTemplate execute the template with the given config map into memory
+func renderTemplate(t renderer, config map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, config); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//targetIsUpToDate check if the file at path already holds exactly content
+func targetIsUpToDate(path string, content []byte) bool {
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(current, content)
+}
+
+//writeTarget write content to path unless it already holds it, returns true when the file changed
+func writeTarget(path string, content []byte) (bool, error) {
+	if targetIsUpToDate(path, content) { // nothing to do, mtime is preserved
+		return false, nil
+	}
+	tmp, err := writeTempTarget(path, content)
+	if err != nil {
+		return false, err
+	}
+	if *validateCmd != "" { // the real target is left untouched if the rendered file is rejected
+		if err := runHook(*validateCmd, tmp); err != nil {
+			os.Remove(tmp)
+			return false, err
+		}
+	}
+	if *backupCount > 0 {
+		if err := backupTarget(path, *backupCount); err != nil {
+			os.Remove(tmp)
+			return false, err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
+
+//hookError error of a validate or reload command, with its output
+type hookError struct {
+	command string
+	output  []byte
+	err     error
+}
+
+func (e *hookError) Error() string {
+	return fmt.Sprintf("command [%s] failed: %s\n%s", e.command, e.err, e.output)
+}
+
+//runHook run command in a shell, {{target}} is replaced by target, quoted as a single shell word
+func runHook(command string, target string) error {
+	command = strings.Replace(command, "{{target}}", shellQuote(target), -1)
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), "DKCONF_TARGET="+target)
+	childLock.Lock() // not reaped by supervise before its status is collected
+	output, err := cmd.CombinedOutput()
+	childLock.Unlock()
+	if err != nil {
+		return &hookError{command, output, err}
+	}
+	return nil
+}
+
+//listBackups list the backups of path, oldest first
+func listBackups(path string) []string {
+	backups, _ := filepath.Glob(path + backupSuffix + "*")
+	sort.Strings(backups) // timestamps are sortable as strings
+	return backups
+}
+
+//backupTarget keep the current version of path as a timestamped backup and remove the oldest ones beyond keep
+func backupTarget(path string, keep int) error {
+	if !checkFileExists(path) {
+		return nil
+	}
+	backup := path + backupSuffix + time.Now().UTC().Format(backupTimeFormat)
+	if err := os.Link(path, backup); err != nil { // the renamed target keeps living under the backup name
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(backup, content, defaultTargetMode); err != nil {
+			return err
+		}
+	}
+	backups := listBackups(path)
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+//rollbackTarget restore the last backup of path, which is consumed
+func rollbackTarget(path string) (string, error) {
+	backups := listBackups(path)
+	if len(backups) == 0 {
+		return "", fmt.Errorf("no backup found for %s", path)
+	}
+	last := backups[len(backups)-1]
+	return last, os.Rename(last, path)
+}
+
+//replaceFile atomically replace the content of path
+func replaceFile(path string, content []byte) error {
+	tmp, err := writeTempTarget(path, content)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+//writeTempTarget write content in a temporary file next to path, keeping the mode of path if it exists
+func writeTempTarget(path string, content []byte) (string, error) {
+	mode := defaultTargetMode
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".dkconf-")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+//reportChange update the changed marker file, if any, according to changed
+func reportChange(changed bool) error {
+	if *changedFile == "" {
+		return nil
+	}
+	if !changed {
+		if err := os.Remove(*changedFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(*changedFile, []byte(*targetFile+"\n"), defaultTargetMode)
+}
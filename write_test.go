@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteTargetOnlyIfChanged(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "target.conf")
+
+	changed, err := writeTarget(path, []byte("hello"))
+	if err != nil || !changed {
+		t.Fatalf("First write should change the target, got changed=%v err=%v", changed, err)
+	}
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(path, old, old)
+
+	changed, err = writeTarget(path, []byte("hello"))
+	if err != nil || changed {
+		t.Errorf("Same content should not change the target, got changed=%v err=%v", changed, err)
+	}
+	if fi, _ := os.Stat(path); !fi.ModTime().Equal(old) {
+		t.Errorf("Mtime should be preserved, got %v want %v", fi.ModTime(), old)
+	}
+
+	changed, err = writeTarget(path, []byte("world"))
+	if err != nil || !changed {
+		t.Errorf("New content should change the target, got changed=%v err=%v", changed, err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "world" {
+		t.Errorf("Target should contain [world], got [%s]", content)
+	}
+}
+
+func TestWriteTargetKeepsMode(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "target.conf")
+	ioutil.WriteFile(path, []byte("old"), 0600)
+	os.Chmod(path, 0600)
+
+	writeTarget(path, []byte("new"))
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Errorf("Mode should be kept, got %v", fi.Mode().Perm())
+	}
+}
+
+func TestReportChange(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	*changedFile = filepath.Join(dir, "changed")
+	defer func() { *changedFile = "" }()
+
+	reportChange(true)
+	if !checkFileExists(*changedFile) {
+		t.Error("Changed file should exist when target changed")
+	}
+	reportChange(false)
+	if checkFileExists(*changedFile) {
+		t.Error("Changed file should be removed when target did not change")
+	}
+}
+
+func TestBackupRotationAndRollback(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "target.conf")
+	*backupCount = 2
+	defer func() { *backupCount = 0 }()
+
+	for _, content := range []string{"v1", "v2", "v3", "v4"} {
+		writeTarget(path, []byte(content))
+	}
+
+	backups := listBackups(path)
+	if len(backups) != 2 {
+		t.Fatalf("Should keep 2 backups, got %v", backups)
+	}
+	if content, _ := ioutil.ReadFile(backups[1]); string(content) != "v3" {
+		t.Errorf("Last backup should contain [v3], got [%s]", content)
+	}
+
+	if _, err := rollbackTarget(path); err != nil {
+		t.Fatalf("Rollback should succeed, got %v", err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "v3" {
+		t.Errorf("Target should be rolled back to [v3], got [%s]", content)
+	}
+	if len(listBackups(path)) != 1 {
+		t.Error("Rollback should consume the restored backup")
+	}
+}
+
+func TestRollbackWithoutBackup(t *testing.T) {
+	if _, err := rollbackTarget(filepath.Join(os.TempDir(), "dkconf-no-such-target")); err == nil {
+		t.Error("Rollback without backup should fail")
+	}
+}
+
+func TestValidateKeepsTargetOnFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "target.conf")
+	ioutil.WriteFile(path, []byte("good"), defaultTargetMode)
+	*validateCmd = "grep -q good {{target}} || (echo invalid config; exit 1)"
+	defer func() { *validateCmd = "" }()
+
+	changed, err := writeTarget(path, []byte("bad"))
+	if changed {
+		t.Error("Target should not change when validation fails")
+	}
+	if herr, ok := err.(*hookError); !ok || string(herr.output) != "invalid config\n" {
+		t.Errorf("Validation should fail with the command output, got %v", err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "good" {
+		t.Errorf("Target should be kept, got [%s]", content)
+	}
+
+	changed, err = writeTarget(path, []byte("still good"))
+	if err != nil || !changed {
+		t.Errorf("Valid content should replace the target, got changed=%v err=%v", changed, err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Temporary files should be cleaned up, got %d files", len(files))
+	}
+}
+
+func TestRunHookQuotesTarget(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "dkconf")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "my app; touch injected $(touch substituted).conf")
+	ioutil.WriteFile(path, []byte("good"), defaultTargetMode)
+
+	if err := runHook("cd "+dir+" && grep -q good {{target}}", path); err != nil {
+		t.Errorf("Hook should find the target, got %v", err)
+	}
+	for _, name := range []string{"touch", "injected", "substituted"} {
+		if checkFileExists(filepath.Join(dir, name)) {
+			t.Errorf("Target path should not be interpreted by the shell, %s was created", name)
+		}
+	}
+}